@@ -0,0 +1,97 @@
+/*
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xenlight
+
+// Go functions called from C.
+//
+// cgo does not allow C definitions in the preamble of a file which
+// exports functions, so the C side of these lives elsewhere. The user
+// or handle argument of each is a cgo.Handle, of a Context or Logger
+// respectively.
+
+/*
+#include <stdint.h>
+#include <libxl.h>
+*/
+import "C"
+
+import (
+	"runtime/cgo"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func contextFromHandle(user C.uintptr_t) *Context {
+	return cgo.Handle(user).Value().(*Context)
+}
+
+//export xenlightChildprocForked
+func xenlightChildprocForked(user C.uintptr_t, pid C.pid_t) {
+	contextFromHandle(user).childprocForked(int(pid))
+}
+
+//export xenlightFdRegister
+func xenlightFdRegister(user C.uintptr_t, fd C.int, events C.short, forLibxl unsafe.Pointer, reg *C.uintptr_t) C.int {
+	r, err := contextFromHandle(user).fdRegister(fd, events, forLibxl)
+	if err != nil {
+		return C.ERROR_OSEVENT_REG_FAIL
+	}
+	*reg = C.uintptr_t(r)
+
+	return 0
+}
+
+//export xenlightFdModify
+func xenlightFdModify(user C.uintptr_t, reg C.uintptr_t, events C.short) C.int {
+	contextFromHandle(user).fdModify(uintptr(reg), events)
+
+	return 0
+}
+
+//export xenlightFdDeregister
+func xenlightFdDeregister(user C.uintptr_t, reg C.uintptr_t) {
+	contextFromHandle(user).fdDeregister(uintptr(reg))
+}
+
+//export xenlightTimeoutRegister
+func xenlightTimeoutRegister(user C.uintptr_t, sec C.long, usec C.long, forLibxl unsafe.Pointer, reg *C.uintptr_t) C.int {
+	abs := time.Unix(int64(sec), int64(usec)*int64(time.Microsecond))
+	*reg = C.uintptr_t(contextFromHandle(user).timeoutRegister(abs, forLibxl))
+
+	return 0
+}
+
+//export xenlightTimeoutModify
+func xenlightTimeoutModify(user C.uintptr_t, reg C.uintptr_t) {
+	contextFromHandle(user).timeoutModify(uintptr(reg))
+}
+
+//export xenlightLogMessage
+func xenlightLogMessage(handle C.uintptr_t, level C.int, errnoval C.int, context *C.char, msg *C.char) {
+	var err error
+	if errnoval > 0 {
+		err = syscall.Errno(errnoval)
+	}
+
+	cgo.Handle(handle).Value().(Logger).Log(LogLevel(level), err, C.GoString(context), C.GoString(msg))
+}
+
+//export xenlightLogProgress
+func xenlightLogProgress(handle C.uintptr_t, context *C.char, doingWhat *C.char, percent C.int, done C.ulong, total C.ulong) {
+	cgo.Handle(handle).Value().(Logger).Progress(C.GoString(context), C.GoString(doingWhat),
+		int(percent), uint64(done), uint64(total))
+}
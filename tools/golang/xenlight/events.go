@@ -0,0 +1,652 @@
+/*
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xenlight
+
+/*
+#cgo LDFLAGS: -lxenlight
+#include <stdlib.h>
+#include <errno.h>
+#include <poll.h>
+#include <sys/time.h>
+#include <libxl.h>
+
+static void xenlight_ao_how_init(libxl_asyncop_how *how, libxl_ev_user for_event)
+{
+	how->callback = NULL;
+	how->u.for_event = for_event;
+}
+
+// Run one beforepoll/poll/afterpoll iteration of libxl's event loop,
+// additionally polling wakefd so that the caller can be interrupted.
+// Returns a libxl error, or 0.
+static int xenlight_poll(libxl_ctx *ctx, int wakefd)
+{
+	struct pollfd *fds = NULL, *newfds;
+	struct timeval now;
+	int nalloc = 0, nfds, timeout, i, rc;
+
+	for (;;) {
+		newfds = realloc(fds, (nalloc + 1) * sizeof(*fds));
+		if (!newfds) {
+			rc = ERROR_NOMEM;
+			goto out;
+		}
+		fds = newfds;
+
+		nfds = nalloc;
+		timeout = -1;
+		gettimeofday(&now, NULL);
+		rc = libxl_osevent_beforepoll(ctx, &nfds, fds, &timeout, now);
+		if (rc != ERROR_BUFFERFULL)
+			break;
+		nalloc = nfds;
+	}
+	if (rc)
+		goto out;
+
+	fds[nfds].fd = wakefd;
+	fds[nfds].events = POLLIN;
+
+	if (poll(fds, nfds + 1, timeout) < 0) {
+		if (errno != EINTR) {
+			rc = ERROR_FAIL;
+			goto out;
+		}
+		for (i = 0; i <= nfds; i++)
+			fds[i].revents = 0;
+	}
+
+	gettimeofday(&now, NULL);
+	libxl_osevent_afterpoll(ctx, nfds, fds, now);
+
+out:
+	free(fds);
+	return rc;
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// AsyncOp controls how a long-running libxl operation is run, and
+// reports its completion. It is the Go counterpart of libxl_asyncop_how.
+//
+// Context methods that take an *AsyncOp wait for the operation to
+// complete if it is nil. Otherwise they return as soon as the operation
+// has been started, and the AsyncOp is completed when libxl reports the
+// operation as finished. Cancelling the context.Context given to
+// NewAsyncOp asks libxl to abort the operation.
+//
+// An AsyncOp must be created with NewAsyncOp, and can only be used for
+// a single operation.
+type AsyncOp struct {
+	ctx  context.Context
+	used int32
+	done chan struct{}
+
+	event Event
+	domid Domid
+	err   error
+
+	// finish is called once libxl no longer uses the parameters
+	// of the operation. It may change the result of the operation
+	// by setting err.
+	finish func(op *AsyncOp)
+}
+
+// NewAsyncOp returns a new AsyncOp. If ctx is cancelled before the
+// operation completes, the operation is aborted.
+func NewAsyncOp(ctx context.Context) *AsyncOp {
+	return &AsyncOp{
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+}
+
+// Done returns a channel that is closed when the operation has
+// completed.
+func (op *AsyncOp) Done() <-chan struct{} {
+	return op.done
+}
+
+// Wait waits for the operation to complete, and returns its result.
+func (op *AsyncOp) Wait() error {
+	<-op.done
+
+	return op.err
+}
+
+// Event returns the OPERATION_COMPLETE event reported by libxl for the
+// operation. It is only valid once the operation has completed.
+func (op *AsyncOp) Event() Event {
+	<-op.done
+
+	return op.event
+}
+
+// Domid returns the ID of the domain the operation acted on. For
+// operations that create a domain, this is the ID of the new domain.
+// It is only valid once the operation has completed.
+func (op *AsyncOp) Domid() Domid {
+	<-op.done
+
+	return op.domid
+}
+
+func (op *AsyncOp) complete(err error) {
+	op.err = err
+	if op.finish != nil {
+		op.finish(op)
+	}
+
+	close(op.done)
+}
+
+// eventHandler is called for each event whose for_user value it was
+// registered with.
+type eventHandler func(ev *Event)
+
+// addEventHandler registers h, and returns the for_user value
+// that events for h must be generated with.
+func (Ctx *Context) addEventHandler(h eventHandler) uint64 {
+	Ctx.evMu.Lock()
+	defer Ctx.evMu.Unlock()
+
+	// 0 is never handed out, so that events not generated on
+	// behalf of a handler are never mistaken for ones that are.
+	Ctx.evNext++
+	Ctx.evHandlers[Ctx.evNext] = h
+
+	return Ctx.evNext
+}
+
+func (Ctx *Context) removeEventHandler(forUser uint64) {
+	Ctx.evMu.Lock()
+	defer Ctx.evMu.Unlock()
+
+	delete(Ctx.evHandlers, forUser)
+}
+
+// startEvents sets up delivery of libxl events for the Context.
+//
+// libxl's fds and timeouts are serviced either through the osevent hooks
+// (see osevent.go), or by a goroutine running libxl's beforepoll/poll/
+// afterpoll loop; and a goroutine dispatches the events libxl generates
+// to the handlers registered with addEventHandler.
+func (Ctx *Context) startEvents(hooks bool) error {
+	Ctx.evHandlers = make(map[uint64]eventHandler)
+	Ctx.watchers = make(map[uint64]*eventWatcher)
+	Ctx.aos = make(map[uint64]C.libxl_asyncop_how)
+	Ctx.goOps = make(map[*AsyncOp]context.CancelFunc)
+
+	if hooks {
+		Ctx.registerOseventHooks()
+	} else {
+		if err := syscall.Pipe2(Ctx.evWake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+			return err
+		}
+		Ctx.evPoll = true
+	}
+
+	Ctx.evKick = make(chan struct{}, 1)
+	Ctx.evStop = make(chan struct{})
+	Ctx.evDone = make(chan struct{})
+
+	// This goroutine will run until ctx.evStop is closed in
+	// ctx.Close(); at which point it will close ctx.evDone.
+	go Ctx.eventLoop()
+
+	return nil
+}
+
+// stopEvents cancels all event watchers, aborts all outstanding
+// asynchronous operations, waits for them to complete, and stops event
+// delivery.
+func (Ctx *Context) stopEvents() {
+	if Ctx.evDone == nil {
+		return
+	}
+
+	Ctx.evMu.Lock()
+	watchers := make([]*eventWatcher, 0, len(Ctx.watchers))
+	for _, w := range Ctx.watchers {
+		watchers = append(watchers, w)
+	}
+	Ctx.evMu.Unlock()
+
+	for _, w := range watchers {
+		w.cancel()
+	}
+
+	Ctx.evMu.Lock()
+	for _, cancel := range Ctx.goOps {
+		cancel()
+	}
+	for forUser := range Ctx.aos {
+		Ctx.abortAsyncLocked(forUser)
+	}
+	Ctx.evMu.Unlock()
+	Ctx.kickEvents()
+	Ctx.aoWait.Wait()
+
+	close(Ctx.evStop)
+	if Ctx.evPoll {
+		Ctx.wakePoll()
+	}
+	<-Ctx.evDone
+	Ctx.evDone = nil
+
+	if Ctx.evPoll {
+		// libxl may still report children being reaped, which
+		// kicks the event loop, until SIGCHLD is detached.
+		Ctx.evWakeMu.Lock()
+		syscall.Close(Ctx.evWake[0])
+		syscall.Close(Ctx.evWake[1])
+		Ctx.evWake = [2]int{-1, -1}
+		Ctx.evWakeMu.Unlock()
+		return
+	}
+
+	Ctx.stopOsevents()
+}
+
+// kickEvents makes the event loop look for newly generated events.
+// libxl may generate events in any thread that calls into it, so this
+// must be called after calls that may have done so.
+func (Ctx *Context) kickEvents() {
+	select {
+	case Ctx.evKick <- struct{}{}:
+	default:
+		// The event loop has yet to look anyway.
+	}
+
+	// libxl may also have changed which fds and timeouts it is
+	// interested in.
+	if Ctx.evPoll {
+		Ctx.wakePoll()
+	}
+}
+
+// wakePoll wakes up pollLoop. It does nothing once the wakeup pipe has
+// been closed by stopEvents, as its fds may have been reused since.
+func (Ctx *Context) wakePoll() {
+	Ctx.evWakeMu.Lock()
+	defer Ctx.evWakeMu.Unlock()
+
+	if Ctx.evWake[1] < 0 {
+		return
+	}
+
+	// If the pipe is full, the event loop has yet to wake up anyway.
+	syscall.Write(Ctx.evWake[1], []byte{0})
+}
+
+func (Ctx *Context) eventLoop() {
+	defer close(Ctx.evDone)
+
+	if Ctx.evPoll {
+		Ctx.pollLoop()
+		return
+	}
+
+	for {
+		select {
+		case <-Ctx.evKick:
+			Ctx.dispatchEvents()
+		case <-Ctx.evStop:
+			return
+		}
+	}
+}
+
+// pollLoop is the event loop used without the osevent hooks.
+func (Ctx *Context) pollLoop() {
+	buf := make([]byte, 64)
+
+	for {
+		select {
+		case <-Ctx.evStop:
+			return
+		default:
+		}
+
+		C.xenlight_poll(Ctx.ctx, C.int(Ctx.evWake[0]))
+
+		for {
+			if n, _ := syscall.Read(Ctx.evWake[0], buf); n <= 0 {
+				break
+			}
+		}
+
+		Ctx.dispatchEvents()
+	}
+}
+
+// dispatchEvents retrieves all events libxl has generated, and passes
+// them on to their handlers.
+func (Ctx *Context) dispatchEvents() {
+	for {
+		var cev *C.libxl_event
+
+		ret := C.libxl_event_check(Ctx.ctx, &cev, C.LIBXL_EVENTMASK_ALL, nil, nil)
+		if ret != 0 {
+			// Either ERROR_NOT_READY, or we will be kicked
+			// again if there is anything to be done.
+			return
+		}
+
+		var ev Event
+		err := ev.fromC(cev)
+		C.libxl_event_free(Ctx.ctx, cev)
+		if err != nil {
+			continue
+		}
+
+		Ctx.evMu.Lock()
+		h := Ctx.evHandlers[ev.ForUser]
+		Ctx.evMu.Unlock()
+
+		if h != nil {
+			h(&ev)
+		}
+	}
+}
+
+// doAsync runs a long-running libxl operation as described by op.
+//
+// start must start the operation by calling the libxl function with the
+// libxl_asyncop_how it is given, and return its result. Parameters
+// passed to libxl must be allocated in C memory, as they need to remain
+// valid until the operation has completed; finish, if not nil, is
+// called at that point to release them.
+func (Ctx *Context) doAsync(op *AsyncOp, start func(how *C.libxl_asyncop_how) C.int, finish func(op *AsyncOp)) error {
+	wait := op == nil
+	if wait {
+		op = NewAsyncOp(context.Background())
+	}
+
+	if !atomic.CompareAndSwapInt32(&op.used, 0, 1) {
+		if finish != nil {
+			// Don't let finish touch the operation op belongs to.
+			finish(&AsyncOp{})
+		}
+		return fmt.Errorf("%v: AsyncOp already used", ErrorInval)
+	}
+	op.finish = finish
+
+	var how C.libxl_asyncop_how
+
+	forUser := Ctx.addEventHandler(func(ev *Event) {
+		Ctx.evMu.Lock()
+		delete(Ctx.evHandlers, ev.ForUser)
+		delete(Ctx.aos, ev.ForUser)
+		Ctx.evMu.Unlock()
+
+		var err error
+		if oc, ok := ev.TypeUnion.(EventTypeUnionOperationComplete); ok && oc.Rc != 0 {
+			err = Error(oc.Rc)
+		}
+		op.event = *ev
+		op.domid = ev.Domid
+
+		// finish may block, or run further operations, so it
+		// must not hold up the event loop.
+		go func() {
+			op.complete(err)
+			Ctx.aoWait.Done()
+		}()
+	})
+	C.xenlight_ao_how_init(&how, C.libxl_ev_user(forUser))
+
+	Ctx.evMu.Lock()
+	Ctx.aos[forUser] = how
+	Ctx.evMu.Unlock()
+	Ctx.aoWait.Add(1)
+
+	ret := start(&how)
+	if ret != 0 {
+		Ctx.evMu.Lock()
+		delete(Ctx.evHandlers, forUser)
+		delete(Ctx.aos, forUser)
+		Ctx.evMu.Unlock()
+
+		op.complete(Error(ret))
+		Ctx.aoWait.Done()
+
+		return op.err
+	}
+
+	// The operation may already have completed.
+	Ctx.kickEvents()
+
+	if cancel := op.ctx.Done(); cancel != nil {
+		go func() {
+			select {
+			case <-cancel:
+				Ctx.evMu.Lock()
+				Ctx.abortAsyncLocked(forUser)
+				Ctx.evMu.Unlock()
+			case <-op.done:
+			}
+		}()
+	}
+
+	if wait {
+		return op.Wait()
+	}
+
+	return nil
+}
+
+// abortAsyncLocked asks libxl to abort the operation started by doAsync
+// with forUser, if it has not completed yet. Ctx.evMu must be held,
+// which keeps the operation from completing while it is aborted.
+func (Ctx *Context) abortAsyncLocked(forUser uint64) {
+	if how, ok := Ctx.aos[forUser]; ok {
+		C.libxl_ao_abort(Ctx.ctx, &how)
+
+		// The operation may have completed in the process.
+		Ctx.kickEvents()
+	}
+}
+
+// goAsync runs an operation made up of several others, implemented by
+// f, as described by op, in the way doAsync runs a single libxl
+// operation. f runs in a goroutine of its own, and is given a
+// context.Context which is cancelled when the context.Context of op is,
+// or the Context is closed; it should pass that on to the operations it
+// runs. f returns the result of the operation, and the ID of the domain
+// it acted on.
+func (Ctx *Context) goAsync(op *AsyncOp, f func(ctx context.Context) (Domid, error)) error {
+	wait := op == nil
+	if wait {
+		op = NewAsyncOp(context.Background())
+	}
+
+	if !atomic.CompareAndSwapInt32(&op.used, 0, 1) {
+		return fmt.Errorf("%v: AsyncOp already used", ErrorInval)
+	}
+
+	ctx, cancel := context.WithCancel(op.ctx)
+
+	Ctx.evMu.Lock()
+	Ctx.goOps[op] = cancel
+	Ctx.evMu.Unlock()
+	Ctx.aoWait.Add(1)
+
+	go func() {
+		domid, err := f(ctx)
+
+		Ctx.evMu.Lock()
+		delete(Ctx.goOps, op)
+		Ctx.evMu.Unlock()
+		cancel()
+
+		op.domid = domid
+		op.complete(err)
+		Ctx.aoWait.Done()
+	}()
+
+	if wait {
+		return op.Wait()
+	}
+
+	return nil
+}
+
+// eventWatcher delivers the events generated by a libxl evgen on a
+// channel.
+//
+// Events are queued, and sent on the channel by a goroutine of the
+// watcher's own, so that a slow receiver does not hold up the delivery
+// of other events.
+type eventWatcher struct {
+	Ctx     *Context
+	forUser uint64
+	c       chan Event
+
+	// disable disables the evgen, once enabled is closed.
+	disable     func()
+	disableOnce sync.Once
+	enabled     chan struct{}
+
+	mu    sync.Mutex
+	queue []Event
+	last  bool
+
+	kick     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// watchEvents creates an eventWatcher. enable must enable the evgen,
+// generating events with the given for_user value, and return the
+// result along with a function to disable it again. If isLast is not
+// nil, it reports whether an event is the last one the evgen will
+// generate; the evgen is then disabled, and the channel closed once the
+// event has been received.
+func (Ctx *Context) watchEvents(enable func(forUser C.libxl_ev_user) (C.int, func()), isLast func(ev *Event) bool) (<-chan Event, func(), error) {
+	w := &eventWatcher{
+		Ctx:     Ctx,
+		c:       make(chan Event),
+		enabled: make(chan struct{}),
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+
+	w.forUser = Ctx.addEventHandler(func(ev *Event) {
+		last := isLast != nil && isLast(ev)
+		w.push(ev, last)
+		if last {
+			w.release()
+		}
+	})
+
+	// The evgen may generate events, and so be disabled, before
+	// enable has even returned.
+	ret, disable := enable(C.libxl_ev_user(w.forUser))
+	w.disable = disable
+	close(w.enabled)
+
+	if ret != 0 {
+		Ctx.removeEventHandler(w.forUser)
+		return nil, nil, Error(ret)
+	}
+
+	Ctx.evMu.Lock()
+	Ctx.watchers[w.forUser] = w
+	Ctx.evMu.Unlock()
+
+	// Events may have been generated straight away.
+	Ctx.kickEvents()
+
+	go w.forward()
+
+	return w.c, w.cancel, nil
+}
+
+func (w *eventWatcher) push(ev *Event, last bool) {
+	w.mu.Lock()
+	w.queue = append(w.queue, *ev)
+	w.last = last
+	w.mu.Unlock()
+
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// release disables the evgen, after which no more events are queued.
+func (w *eventWatcher) release() {
+	<-w.enabled
+
+	w.disableOnce.Do(func() {
+		w.Ctx.evMu.Lock()
+		delete(w.Ctx.watchers, w.forUser)
+		w.Ctx.evMu.Unlock()
+
+		w.disable()
+		w.Ctx.removeEventHandler(w.forUser)
+	})
+}
+
+// cancel disables the evgen, discards any queued events, and closes
+// the channel.
+func (w *eventWatcher) cancel() {
+	w.release()
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *eventWatcher) forward() {
+	defer close(w.c)
+
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			last := w.last
+			w.mu.Unlock()
+
+			if last {
+				return
+			}
+
+			select {
+			case <-w.kick:
+				continue
+			case <-w.stop:
+				return
+			}
+		}
+		ev := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.c <- ev:
+		case <-w.stop:
+			return
+		}
+	}
+}
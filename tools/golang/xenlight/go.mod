@@ -1 +1,4 @@
 module github.com/enr0n/xen/tools/golang/xenlight
+
+// Live migration uses context.AfterFunc and binary.NativeEndian.
+go 1.21
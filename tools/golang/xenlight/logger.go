@@ -0,0 +1,222 @@
+/*
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xenlight
+
+/*
+#cgo LDFLAGS: -lxentoollog
+#include <stdlib.h>
+#include <stdint.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <string.h>
+#include <unistd.h>
+#include <xentoollog.h>
+
+// Implemented in callbacks.go.
+extern void xenlightLogMessage(uintptr_t handle, int level, int errnoval,
+                               char *context, char *msg);
+extern void xenlightLogProgress(uintptr_t handle, char *context,
+                                char *doing_what, int percent,
+                                unsigned long done, unsigned long total);
+
+// A xentoollog_logger which passes messages on to a Go Logger.
+typedef struct {
+	xentoollog_logger vtable;
+	uintptr_t handle;
+	int min_level;
+	pid_t pid;
+} xenlight_logger;
+
+// libxl also logs from the processes it forks, which must not call into
+// Go. Their messages are written to stderr instead.
+static int xenlight_logger_forked(xenlight_logger *lg)
+{
+	return getpid() != lg->pid;
+}
+
+static void xenlight_logger_vmessage(xentoollog_logger *logger,
+                                     xentoollog_level level, int errnoval,
+                                     const char *context, const char *format,
+                                     va_list al)
+{
+	xenlight_logger *lg = (xenlight_logger *)logger;
+	va_list al2;
+	char *msg;
+	int len;
+
+	if (level < __atomic_load_n(&lg->min_level, __ATOMIC_RELAXED))
+		return;
+
+	if (xenlight_logger_forked(lg)) {
+		if (context)
+			fprintf(stderr, "%s: ", context);
+		vfprintf(stderr, format, al);
+		if (errnoval >= 0)
+			fprintf(stderr, ": %s", strerror(errnoval));
+		fputc('\n', stderr);
+		return;
+	}
+
+	va_copy(al2, al);
+	len = vsnprintf(NULL, 0, format, al2);
+	va_end(al2);
+	if (len < 0)
+		return;
+
+	msg = malloc(len + 1);
+	if (!msg)
+		return;
+	vsnprintf(msg, len + 1, format, al);
+
+	xenlightLogMessage(lg->handle, level, errnoval, (char *)context, msg);
+	free(msg);
+}
+
+static void xenlight_logger_progress(xentoollog_logger *logger,
+                                     const char *context,
+                                     const char *doing_what, int percent,
+                                     unsigned long done, unsigned long total)
+{
+	xenlight_logger *lg = (xenlight_logger *)logger;
+
+	if (XTL_PROGRESS < __atomic_load_n(&lg->min_level, __ATOMIC_RELAXED))
+		return;
+
+	if (xenlight_logger_forked(lg)) {
+		fprintf(stderr, "%s%s%s: %d%%\n", context ? context : "",
+		        context ? ": " : "", doing_what, percent);
+		return;
+	}
+
+	xenlightLogProgress(lg->handle, (char *)context, (char *)doing_what,
+	                    percent, done, total);
+}
+
+static void xenlight_logger_destroy(xentoollog_logger *logger)
+{
+	free(logger);
+}
+
+static xentoollog_logger *xenlight_logger_create(uintptr_t handle, int min_level)
+{
+	xenlight_logger *lg = malloc(sizeof(*lg));
+
+	if (!lg)
+		return NULL;
+
+	lg->vtable.vmessage = xenlight_logger_vmessage;
+	lg->vtable.progress = xenlight_logger_progress;
+	lg->vtable.destroy = xenlight_logger_destroy;
+	lg->handle = handle;
+	lg->min_level = min_level;
+	lg->pid = getpid();
+
+	return &lg->vtable;
+}
+
+static void xenlight_logger_set_minlevel(xentoollog_logger *logger, int min_level)
+{
+	xenlight_logger *lg = (xenlight_logger *)logger;
+
+	__atomic_store_n(&lg->min_level, min_level, __ATOMIC_RELAXED);
+}
+*/
+import "C"
+
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// LogLevel represents a xentoollog_level.
+type LogLevel int
+
+const (
+	LogLevelDebug    LogLevel = C.XTL_DEBUG
+	LogLevelVerbose  LogLevel = C.XTL_VERBOSE
+	LogLevelDetail   LogLevel = C.XTL_DETAIL
+	LogLevelProgress LogLevel = C.XTL_PROGRESS
+	LogLevelInfo     LogLevel = C.XTL_INFO
+	LogLevelNotice   LogLevel = C.XTL_NOTICE
+	LogLevelWarn     LogLevel = C.XTL_WARN
+	LogLevelError    LogLevel = C.XTL_ERROR
+	LogLevelCritical LogLevel = C.XTL_CRITICAL
+)
+
+func (l LogLevel) String() string {
+	// No need to free const return value
+	return C.GoString(C.xtl_level_to_string(C.xentoollog_level(l)))
+}
+
+// Logger receives the messages logged by libxl.
+//
+// Its methods may be called from any goroutine, including concurrently.
+// They are called with the libxl context lock held, so must not call
+// back into the Context.
+type Logger interface {
+	// Log is called for each message at or above the log level of
+	// the Context. err is the errno value associated with the
+	// message, if any. context names the component the message
+	// comes from (eg. "libxl"), and may be empty.
+	Log(level LogLevel, err error, context string, msg string)
+
+	// Progress reports the progress of a long-running activity,
+	// if the log level of the Context is at most LogLevelProgress.
+	// It is called with done == 0 whenever a new activity starts.
+	Progress(context string, doingWhat string, percent int, done, total uint64)
+}
+
+// newLogger creates the xentoollog_logger for a Context. If logger is
+// nil, messages are written to stderr.
+func (Ctx *Context) newLogger(logger Logger, level LogLevel) error {
+	if logger == nil {
+		Ctx.logger = (*C.xentoollog_logger)(unsafe.Pointer(
+			C.xtl_createlogger_stdiostream(C.stderr, C.xentoollog_level(level), 0)))
+	} else {
+		Ctx.logHandle = cgo.NewHandle(logger)
+		Ctx.logger = C.xenlight_logger_create(C.uintptr_t(Ctx.logHandle), C.int(level))
+	}
+
+	if Ctx.logger == nil {
+		return ErrorNomem
+	}
+
+	return nil
+}
+
+func (Ctx *Context) destroyLogger() {
+	if Ctx.logger != nil {
+		C.xtl_logger_destroy(Ctx.logger)
+		Ctx.logger = nil
+	}
+
+	if Ctx.logHandle != 0 {
+		Ctx.logHandle.Delete()
+		Ctx.logHandle = 0
+	}
+}
+
+// SetLogLevel sets the level below which messages logged by libxl are
+// discarded.
+func (Ctx *Context) SetLogLevel(level LogLevel) {
+	if Ctx.logHandle != 0 {
+		C.xenlight_logger_set_minlevel(Ctx.logger, C.int(level))
+		return
+	}
+
+	C.xtl_stdiostream_set_minlevel((*C.xentoollog_logger_stdiostream)(unsafe.Pointer(Ctx.logger)),
+		C.xentoollog_level(level))
+}
@@ -0,0 +1,487 @@
+/*
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xenlight
+
+/*
+#cgo LDFLAGS: -lxenlight
+#include <stdlib.h>
+#include <string.h>
+#include <libxl.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+	"unsafe"
+)
+
+// Live migration, speaking the same protocol as xl migrate and xl
+// migrate-receive (see tools/xl/xl_migrate.c), so that either end may
+// be xl.
+//
+// The receiver sends a banner; the sender replies with an xl save file
+// header carrying the domain configuration, followed by the libxl
+// migration stream. Once the domain has been restored, paused and under
+// a temporary name, the receiver says it is ready; the sender renames
+// its copy away, and gives the receiver permission to go. The receiver
+// renames and unpauses its copy, and reports the result, after which
+// the sender destroys its copy. If the receiver fails to start the
+// domain, it destroys its copy, and gives the sender permission to
+// resume the original.
+
+const (
+	migrateReceiverBanner  = "xl migration receiver ready, send binary domain data.\n"
+	migrateReceiverReady   = "domain received, ready to unpause\x00"
+	migratePermissionToGo  = "domain is yours, you are cleared to unpause\x00"
+	migrateReport          = "my copy unpause results are as follows\x00"
+	saveFileHeaderMagic    = "Xen saved domain, xl format\n \x00 \r"
+	saveFileByteOrderValue = 0x01020304
+
+	saveFileFlagJSON     = 1 << 0
+	saveFileFlagStreamV2 = 1 << 1
+	saveFileFlagAll      = saveFileFlagJSON | saveFileFlagStreamV2
+)
+
+// ErrMigrationInDoubt is returned by MigrateDomain when the migration
+// failed during the final handshake. It is then unknown whether the
+// domain is running at the receiver, so both ends must be checked before
+// resuming at most one copy of the domain. The copy at the sender is left
+// suspended, and renamed to "<name>--migratedaway".
+var ErrMigrationInDoubt = errors.New("migration failed during final handshake; domain state is undefined")
+
+// MigrateOptions controls how MigrateDomain migrates a domain.
+type MigrateOptions struct {
+	// Debug makes the migration verify that the domain's memory is
+	// unchanged once it has been suspended (LIBXL_SUSPEND_DEBUG).
+	Debug bool
+}
+
+// MigrateReceiveOptions controls how MigrateReceive receives a domain.
+type MigrateReceiveOptions struct {
+	// Paused leaves the domain paused once it has been received.
+	Paused bool
+}
+
+// saveFileHeader is an xl save file header.
+type saveFileHeader struct {
+	Magic           [32]byte
+	ByteOrder       uint32
+	MandatoryFlags  uint32
+	OptionalFlags   uint32
+	OptionalDataLen uint32
+}
+
+// The header is in the byte order of the domain, which is that of the
+// host.
+var saveFileByteOrder = binary.NativeEndian
+
+func writeMigrateConfig(w io.Writer, config []byte) error {
+	order := saveFileByteOrder
+
+	var opt bytes.Buffer
+	binary.Write(&opt, order, uint32(len(config)))
+	opt.Write(config)
+
+	hdr := saveFileHeader{
+		ByteOrder:       saveFileByteOrderValue,
+		MandatoryFlags:  saveFileFlagStreamV2 | saveFileFlagJSON,
+		OptionalDataLen: uint32(opt.Len()),
+	}
+	copy(hdr.Magic[:], saveFileHeaderMagic)
+
+	if err := binary.Write(w, order, &hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(opt.Bytes())
+
+	return err
+}
+
+// readMigrateConfig reads the header written by writeMigrateConfig, and
+// returns the configuration in it, and the version of the stream that
+// follows.
+func readMigrateConfig(r io.Reader) (config []byte, streamVersion uint32, err error) {
+	order := saveFileByteOrder
+
+	var hdr saveFileHeader
+	if err = binary.Read(r, order, &hdr); err != nil {
+		return nil, 0, err
+	}
+	if string(hdr.Magic[:]) != saveFileHeaderMagic {
+		return nil, 0, fmt.Errorf("%v: stream has wrong magic number", ErrorInval)
+	}
+	if hdr.ByteOrder != saveFileByteOrderValue {
+		return nil, 0, fmt.Errorf("%v: stream has wrong byte order", ErrorInval)
+	}
+	if bad := hdr.MandatoryFlags &^ saveFileFlagAll; bad != 0 {
+		return nil, 0, fmt.Errorf("%v: stream has unsupported mandatory flags %#x", ErrorInval, bad)
+	}
+	if hdr.MandatoryFlags&saveFileFlagJSON == 0 {
+		return nil, 0, fmt.Errorf("%v: stream has no domain config in JSON format", ErrorInval)
+	}
+
+	opt := make([]byte, hdr.OptionalDataLen)
+	if _, err = io.ReadFull(r, opt); err != nil {
+		return nil, 0, err
+	}
+	if len(opt) < 4 {
+		return nil, 0, fmt.Errorf("%v: stream has no domain config", ErrorInval)
+	}
+	n := order.Uint32(opt)
+	if uint64(n) > uint64(len(opt)-4) {
+		return nil, 0, fmt.Errorf("%v: stream header truncated", ErrorInval)
+	}
+	config = opt[4 : 4+n]
+
+	streamVersion = 1
+	if hdr.MandatoryFlags&saveFileFlagStreamV2 != 0 {
+		streamVersion = 2
+	}
+
+	return config, streamVersion, nil
+}
+
+func readMigrateMessage(r io.Reader, msg string) error {
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("migration stream contained unexpected data instead of %q", msg)
+	}
+
+	return nil
+}
+
+func writeMigrateMessage(w io.Writer, msg string) error {
+	_, err := io.WriteString(w, msg)
+
+	return err
+}
+
+// interruptConn makes blocking I/O on conn fail once ctx is cancelled,
+// by setting a deadline in the past. The returned function stops this
+// from happening, if it has not already.
+func interruptConn(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// migrateError reports err as caused by the cancellation of ctx, if it
+// was.
+func migrateError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ErrMigrationInDoubt) {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+
+	return err
+}
+
+// domainConfigJSON returns the name of a domain, and its current
+// configuration as a NUL-terminated JSON string, as xl sends it.
+func (Ctx *Context) domainConfigJSON(ctx context.Context, domid Domid) (name string, config []byte, err error) {
+	cconfig := (*C.libxl_domain_config)(C.calloc(1, C.sizeof_libxl_domain_config))
+	C.libxl_domain_config_init(cconfig)
+
+	op := NewAsyncOp(ctx)
+	err = Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_retrieve_domain_configuration(Ctx.ctx, C.uint32_t(domid), cconfig, how)
+	}, func(op *AsyncOp) {
+		defer func() {
+			C.libxl_domain_config_dispose(cconfig)
+			C.free(unsafe.Pointer(cconfig))
+		}()
+
+		if op.err != nil {
+			return
+		}
+
+		// Let the receiver choose the domid.
+		cconfig.c_info.domid = 0
+		name = C.GoString(cconfig.c_info.name)
+
+		cjson := C.libxl_domain_config_to_json(Ctx.ctx, cconfig)
+		if cjson == nil {
+			op.err = ErrorNomem
+			return
+		}
+		config = C.GoBytes(unsafe.Pointer(cjson), C.int(C.strlen(cjson)+1))
+		C.free(unsafe.Pointer(cjson))
+	})
+	if err == nil {
+		err = op.Wait()
+	}
+
+	return name, config, err
+}
+
+// MigrateDomain live-migrates a domain to the receiver at the other end
+// of conn, which must be running MigrateReceive or xl migrate-receive.
+// opts may be nil.
+//
+// If the migration fails before the receiver has been given permission
+// to start the domain, the domain is resumed. If it fails afterwards,
+// ErrMigrationInDoubt is returned. Once the migration has succeeded, the
+// domain is destroyed.
+//
+// Cancelling op aborts the migration, by also making I/O on conn fail.
+// Once the receiver has been given permission to start the domain, this
+// too results in ErrMigrationInDoubt.
+func (Ctx *Context) MigrateDomain(domid Domid, conn net.Conn, opts *MigrateOptions, op *AsyncOp) error {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+
+	return Ctx.goAsync(op, func(ctx context.Context) (Domid, error) {
+		stop := interruptConn(ctx, conn)
+		defer stop()
+
+		err := Ctx.migrateDomain(ctx, domid, conn, opts)
+
+		return domid, migrateError(ctx, err)
+	})
+}
+
+func (Ctx *Context) migrateDomain(ctx context.Context, domid Domid, conn net.Conn, opts *MigrateOptions) error {
+	name, config, err := Ctx.domainConfigJSON(ctx, domid)
+	if err != nil {
+		return fmt.Errorf("retrieving domain configuration: %v", err)
+	}
+
+	if err := readMigrateMessage(conn, migrateReceiverBanner); err != nil {
+		return fmt.Errorf("reading banner from receiver: %v", err)
+	}
+	if err := writeMigrateConfig(conn, config); err != nil {
+		return fmt.Errorf("sending domain configuration: %v", err)
+	}
+
+	flags := C.int(C.LIBXL_SUSPEND_LIVE)
+	if opts.Debug {
+		flags |= C.LIBXL_SUSPEND_DEBUG
+	}
+	op := NewAsyncOp(ctx)
+	err = Ctx.suspendDomain(domid, conn, flags, nil, op)
+	if err == nil {
+		err = op.Wait()
+	}
+	if err != nil {
+		if err != ErrorGuestTimedout {
+			Ctx.DomainResume(domid, true, nil)
+		}
+		return fmt.Errorf("suspending domain: %v", err)
+	}
+
+	resume := func(err error) error {
+		Ctx.DomainResume(domid, true, nil)
+		return err
+	}
+
+	if err := readMigrateMessage(conn, migrateReceiverReady); err != nil {
+		return resume(fmt.Errorf("reading ready message from receiver: %v", err))
+	}
+
+	// Before giving the receiver permission to rename and resume the
+	// domain, rename it away here.
+	awayName := name + "--migratedaway"
+	if name != "" {
+		if err := Ctx.DomainRename(domid, name, awayName); err != nil {
+			return resume(fmt.Errorf("renaming domain: %v", err))
+		}
+	}
+
+	// The point of no return: once the receiver may have been told to
+	// go, it is not safe to carry on here.
+	inDoubt := func(err error) error {
+		return fmt.Errorf("%w: %v", ErrMigrationInDoubt, err)
+	}
+
+	if err := writeMigrateMessage(conn, migratePermissionToGo); err != nil {
+		return inDoubt(err)
+	}
+	if err := readMigrateMessage(conn, migrateReport); err != nil {
+		return inDoubt(err)
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return inDoubt(err)
+	}
+
+	if status[0] != 0 {
+		if err := readMigrateMessage(conn, migratePermissionToGo); err != nil {
+			return inDoubt(err)
+		}
+
+		if name != "" {
+			Ctx.DomainRename(domid, awayName, name)
+		}
+		if err := Ctx.DomainResume(domid, true, nil); err != nil {
+			return fmt.Errorf("receiver failed to start domain (status %d), and resuming it failed: %v",
+				status[0], err)
+		}
+
+		return fmt.Errorf("receiver failed to start domain (status %d)", status[0])
+	}
+
+	return Ctx.DomainDestroy(domid, nil)
+}
+
+// MigrateReceive receives a domain live-migrated by MigrateDomain or xl
+// migrate from the other end of conn, and returns the ID of the new
+// domain. opts may be nil.
+//
+// If op is not nil, the returned Domid is not valid; the ID of the new
+// domain is instead given by op.Domid once the operation has completed.
+// Cancelling op aborts the migration, by also making I/O on conn fail.
+func (Ctx *Context) MigrateReceive(conn net.Conn, opts *MigrateReceiveOptions, op *AsyncOp) (Domid, error) {
+	if opts == nil {
+		opts = &MigrateReceiveOptions{}
+	}
+
+	wait := op == nil
+	if wait {
+		op = NewAsyncOp(context.Background())
+	}
+
+	err := Ctx.goAsync(op, func(ctx context.Context) (Domid, error) {
+		stop := interruptConn(ctx, conn)
+		defer stop()
+
+		domid, err := Ctx.migrateReceive(ctx, conn, opts)
+
+		return domid, migrateError(ctx, err)
+	})
+	if err != nil || !wait {
+		return Domid(0), err
+	}
+
+	if err := op.Wait(); err != nil {
+		return Domid(0), err
+	}
+
+	return op.Domid(), nil
+}
+
+func (Ctx *Context) migrateReceive(ctx context.Context, conn net.Conn, opts *MigrateReceiveOptions) (Domid, error) {
+
+	if err := writeMigrateMessage(conn, migrateReceiverBanner); err != nil {
+		return Domid(0), fmt.Errorf("sending banner: %v", err)
+	}
+
+	config, streamVersion, err := readMigrateConfig(conn)
+	if err != nil {
+		return Domid(0), fmt.Errorf("reading domain configuration: %v", err)
+	}
+
+	cconfig := (*C.libxl_domain_config)(C.calloc(1, C.sizeof_libxl_domain_config))
+	C.libxl_domain_config_init(cconfig)
+
+	cjson := C.CString(string(config))
+	ret := C.libxl_domain_config_from_json(Ctx.ctx, cconfig, cjson)
+	C.free(unsafe.Pointer(cjson))
+	if ret != 0 {
+		C.libxl_domain_config_dispose(cconfig)
+		C.free(unsafe.Pointer(cconfig))
+		return Domid(0), fmt.Errorf("parsing domain configuration: %v", Error(ret))
+	}
+
+	// Receive the domain under a temporary name.
+	name := C.GoString(cconfig.c_info.name)
+	incomingName := name + "--incoming"
+	if name != "" {
+		C.free(unsafe.Pointer(cconfig.c_info.name))
+		cconfig.c_info.name = C.CString(incomingName)
+	}
+
+	s, err := newInStream(conn)
+	if err != nil {
+		C.libxl_domain_config_dispose(cconfig)
+		C.free(unsafe.Pointer(cconfig))
+		return Domid(0), err
+	}
+
+	params := &DomainRestoreParams{
+		StreamVersion: streamVersion,
+	}
+	op := NewAsyncOp(ctx)
+	_, err = Ctx.restoreDomain(cconfig, s, params, op)
+	if err == nil {
+		err = op.Wait()
+	}
+	if err != nil {
+		return Domid(0), fmt.Errorf("restoring domain: %v", err)
+	}
+	domid := op.Domid()
+
+	// The rest of the handshake follows the migration stream.
+	r := s.remainder()
+
+	// Closing the stream cleared any deadline set on conn by the
+	// cancellation of ctx.
+	if err := ctx.Err(); err != nil {
+		Ctx.DomainDestroy(domid, nil)
+		return Domid(0), err
+	}
+
+	if err := writeMigrateMessage(conn, migrateReceiverReady); err != nil {
+		Ctx.DomainDestroy(domid, nil)
+		return Domid(0), fmt.Errorf("sending ready message: %v", err)
+	}
+
+	err = readMigrateMessage(r, migratePermissionToGo)
+	if err == nil && name != "" {
+		err = Ctx.DomainRename(domid, incomingName, name)
+	}
+	if err == nil && !opts.Paused {
+		err = Ctx.DomainUnpause(domid, nil)
+	}
+
+	// Report the result as a positive libxl error code.
+	var status byte
+	if err != nil {
+		status = byte(-ErrorFail)
+		if e, ok := err.(Error); ok {
+			status = byte(-e)
+		}
+	}
+
+	if werr := writeMigrateMessage(conn, migrateReport); werr != nil {
+		return domid, fmt.Errorf("sending report: %v", werr)
+	}
+	if _, werr := conn.Write([]byte{status}); werr != nil {
+		return domid, fmt.Errorf("sending report: %v", werr)
+	}
+
+	if err == nil {
+		return domid, nil
+	}
+
+	if derr := Ctx.DomainDestroy(domid, nil); derr != nil {
+		return Domid(0), fmt.Errorf("starting domain failed: %v; destroying it failed: %v", err, derr)
+	}
+	if werr := writeMigrateMessage(conn, migratePermissionToGo); werr != nil {
+		return Domid(0), fmt.Errorf("starting domain failed: %v; giving it back failed: %v", err, werr)
+	}
+
+	return Domid(0), fmt.Errorf("starting domain: %v", err)
+}
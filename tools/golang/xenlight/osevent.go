@@ -0,0 +1,428 @@
+/*
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xenlight
+
+/*
+#cgo LDFLAGS: -lxenlight
+#include <stdint.h>
+#include <errno.h>
+#include <poll.h>
+#include <sys/time.h>
+#include <libxl.h>
+
+// Implemented in callbacks.go.
+extern int xenlightFdRegister(uintptr_t user, int fd, short events,
+                              void *for_libxl, uintptr_t *reg);
+extern int xenlightFdModify(uintptr_t user, uintptr_t reg, short events);
+extern void xenlightFdDeregister(uintptr_t user, uintptr_t reg);
+extern int xenlightTimeoutRegister(uintptr_t user, long sec, long usec,
+                                   void *for_libxl, uintptr_t *reg);
+extern void xenlightTimeoutModify(uintptr_t user, uintptr_t reg);
+
+static int fd_register(void *user, int fd, void **for_app_registration_out,
+                       short events, void *for_libxl)
+{
+	uintptr_t reg;
+	int rc;
+
+	rc = xenlightFdRegister((uintptr_t)user, fd, events, for_libxl, &reg);
+	if (!rc)
+		*for_app_registration_out = (void *)reg;
+
+	return rc;
+}
+
+static int fd_modify(void *user, int fd, void **for_app_registration_update,
+                     short events)
+{
+	return xenlightFdModify((uintptr_t)user,
+	                        (uintptr_t)*for_app_registration_update, events);
+}
+
+static void fd_deregister(void *user, int fd, void *for_app_registration)
+{
+	xenlightFdDeregister((uintptr_t)user, (uintptr_t)for_app_registration);
+}
+
+static int timeout_register(void *user, void **for_app_registration_out,
+                            struct timeval abs, void *for_libxl)
+{
+	uintptr_t reg;
+	int rc;
+
+	rc = xenlightTimeoutRegister((uintptr_t)user, abs.tv_sec, abs.tv_usec,
+	                             for_libxl, &reg);
+	if (!rc)
+		*for_app_registration_out = (void *)reg;
+
+	return rc;
+}
+
+static int timeout_modify(void *user, void **for_app_registration_update,
+                          struct timeval abs)
+{
+	// libxl only ever asks for the timeout to occur right away.
+	xenlightTimeoutModify((uintptr_t)user,
+	                      (uintptr_t)*for_app_registration_update);
+
+	return 0;
+}
+
+static void timeout_deregister(void *user, void *for_app_registration)
+{
+	// Never called by libxl.
+}
+
+static const libxl_osevent_hooks osevent_hooks = {
+	.fd_register = fd_register,
+	.fd_modify = fd_modify,
+	.fd_deregister = fd_deregister,
+	.timeout_register = timeout_register,
+	.timeout_modify = timeout_modify,
+	.timeout_deregister = timeout_deregister,
+};
+
+static void xenlight_osevent_register_hooks(libxl_ctx *ctx, uintptr_t user)
+{
+	libxl_osevent_register_hooks(ctx, &osevent_hooks, (void *)user);
+}
+
+// Returns the events which have occurred on fd, without waiting.
+static short xenlight_poll_fd(int fd, short events)
+{
+	struct pollfd pfd = { .fd = fd, .events = events };
+
+	if (poll(&pfd, 1, 0) < 0)
+		return 0;
+
+	return pfd.revents;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// libxl asks to be told about activity on its fds, and about timeouts,
+// through the osevent hooks registered here.
+//
+// Each fd registration is watched by a goroutine, which waits for the fd
+// using the Go runtime's network poller, through an *os.File for a
+// duplicate of it, so that no thread is tied up. Changes to the
+// registration interrupt the wait by setting a deadline on the file.
+// Timeouts are implemented with time.AfterFunc. In both cases libxl is
+// called from a goroutine of its own, as it forbids reporting osevents
+// from within a hook; and the event loop is kicked afterwards, as that
+// is when libxl generates events.
+
+// oseventFd is an fd registration.
+type oseventFd struct {
+	fd       C.int
+	forLibxl unsafe.Pointer
+
+	// file is a duplicate of fd. If pollable is false, the poller
+	// does not support it, which is the case for regular files;
+	// those are always ready.
+	file     *os.File
+	raw      syscall.RawConn
+	pollable bool
+
+	// changed is signalled when the registration changes.
+	changed chan struct{}
+
+	// Protected by Context.osMu.
+	events C.short
+	dead   bool
+}
+
+// oseventTimeout is a timeout registration.
+type oseventTimeout struct {
+	forLibxl unsafe.Pointer
+	timer    *time.Timer
+}
+
+func (Ctx *Context) registerOseventHooks() {
+	Ctx.osFds = make(map[uintptr]*oseventFd)
+	Ctx.osTimeouts = make(map[uintptr]*oseventTimeout)
+
+	C.xenlight_osevent_register_hooks(Ctx.ctx, C.uintptr_t(Ctx.handle))
+}
+
+// stopOsevents stops reporting osevents to libxl. Goroutines may keep
+// running until libxl deregisters their fds.
+func (Ctx *Context) stopOsevents() {
+	Ctx.osLive.Lock()
+	Ctx.osClosed = true
+	Ctx.osLive.Unlock()
+
+	Ctx.osMu.Lock()
+	for _, t := range Ctx.osTimeouts {
+		t.timer.Stop()
+	}
+	Ctx.osMu.Unlock()
+}
+
+// oseventOccurred calls f, which reports an osevent to libxl, unless
+// the Context is being closed.
+func (Ctx *Context) oseventOccurred(f func()) {
+	Ctx.osLive.RLock()
+	if !Ctx.osClosed {
+		f()
+	}
+	Ctx.osLive.RUnlock()
+
+	Ctx.kickEvents()
+}
+
+// Context.osMu must be held.
+func (Ctx *Context) oseventRegistration() uintptr {
+	Ctx.osNext++
+
+	return Ctx.osNext
+}
+
+func (Ctx *Context) fdRegister(fd C.int, events C.short, forLibxl unsafe.Pointer) (uintptr, error) {
+	r := &oseventFd{
+		fd:       fd,
+		forLibxl: forLibxl,
+		changed:  make(chan struct{}, 1),
+		events:   events,
+	}
+
+	file, err := pollableFile(int(fd))
+	if err != nil {
+		return 0, err
+	}
+	r.file = file
+	if r.raw, err = file.SyscallConn(); err != nil {
+		file.Close()
+		return 0, err
+	}
+	r.pollable = !errors.Is(file.SetDeadline(time.Time{}), os.ErrNoDeadline)
+
+	Ctx.osMu.Lock()
+	reg := Ctx.oseventRegistration()
+	Ctx.osFds[reg] = r
+	Ctx.osMu.Unlock()
+
+	go Ctx.watchFd(r)
+
+	return reg, nil
+}
+
+func (Ctx *Context) fdModify(reg uintptr, events C.short) {
+	Ctx.osMu.Lock()
+	defer Ctx.osMu.Unlock()
+
+	r := Ctx.osFds[reg]
+	r.events = events
+	r.wakeup()
+}
+
+func (Ctx *Context) fdDeregister(reg uintptr) {
+	Ctx.osMu.Lock()
+	defer Ctx.osMu.Unlock()
+
+	r := Ctx.osFds[reg]
+	r.dead = true
+	delete(Ctx.osFds, reg)
+	r.wakeup()
+}
+
+// pollableFile returns an *os.File for a duplicate of fd, registered
+// with the poller if it supports fd.
+func pollableFile(fd int) (*os.File, error) {
+	dup, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_DUPFD_CLOEXEC, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	// os.NewFile only registers non-blocking fds with the poller.
+	// The flag is shared with fd, so put it back as libxl had it
+	// afterwards; the file is only ever polled, never read from or
+	// written to.
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, dup, syscall.F_GETFL, 0)
+	if errno != 0 {
+		syscall.Close(int(dup))
+		return nil, errno
+	}
+	blocking := flags&syscall.O_NONBLOCK == 0
+	if blocking {
+		if err := syscall.SetNonblock(int(dup), true); err != nil {
+			syscall.Close(int(dup))
+			return nil, err
+		}
+	}
+
+	file := os.NewFile(dup, "libxl fd")
+
+	if blocking {
+		syscall.SetNonblock(int(dup), false)
+	}
+
+	return file, nil
+}
+
+// wakeup tells the goroutine watching r that r has changed. Context.osMu
+// must be held, so that the goroutine cannot have closed the file yet.
+func (r *oseventFd) wakeup() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+		// The goroutine has yet to wake up anyway.
+	}
+
+	if r.pollable {
+		r.file.SetDeadline(time.Unix(1, 0))
+	}
+}
+
+// wait waits for events on r's fd, and returns those which occurred. It
+// returns 0 if r changed in the meantime.
+func (r *oseventFd) wait(events C.short) C.short {
+	// An fd registered for no events must still not be reported,
+	// even on error or hangup.
+	if events != 0 && !r.pollable {
+		if revents := C.xenlight_poll_fd(r.fd, events); revents != 0 {
+			return revents
+		}
+	}
+	if events == 0 || !r.pollable {
+		<-r.changed
+		return 0
+	}
+
+	var mu sync.Mutex
+	var revents C.short
+	check := func(fd uintptr) bool {
+		rev := C.xenlight_poll_fd(C.int(fd), events)
+		if rev == 0 {
+			return false
+		}
+
+		mu.Lock()
+		revents |= rev
+		mu.Unlock()
+
+		return true
+	}
+
+	read := events&^C.POLLOUT != 0
+	write := events&C.POLLOUT != 0
+
+	switch {
+	case read && write:
+		// Whichever finishes first stops the other.
+		done := make(chan struct{})
+		go func() {
+			r.raw.Write(check)
+			r.file.SetReadDeadline(time.Unix(1, 0))
+			close(done)
+		}()
+		r.raw.Read(check)
+		r.file.SetWriteDeadline(time.Unix(1, 0))
+		<-done
+
+	case write:
+		r.raw.Write(check)
+
+	default:
+		r.raw.Read(check)
+	}
+
+	return revents
+}
+
+func (Ctx *Context) watchFd(r *oseventFd) {
+	defer r.file.Close()
+
+	for {
+		Ctx.osMu.Lock()
+		events, dead := r.events, r.dead
+		if r.pollable {
+			// Clear any deadline left by wakeup, or by wait.
+			r.file.SetDeadline(time.Time{})
+		}
+		Ctx.osMu.Unlock()
+
+		if dead {
+			return
+		}
+
+		revents := r.wait(events)
+		if revents == 0 {
+			continue
+		}
+
+		// libxl copes with being told about events on an fd
+		// which was modified or deregistered in the meantime.
+		Ctx.oseventOccurred(func() {
+			C.libxl_osevent_occurred_fd(Ctx.ctx, r.forLibxl, r.fd, events, revents)
+		})
+	}
+}
+
+func (Ctx *Context) timeoutRegister(abs time.Time, forLibxl unsafe.Pointer) uintptr {
+	t := &oseventTimeout{
+		forLibxl: forLibxl,
+	}
+
+	Ctx.osMu.Lock()
+	defer Ctx.osMu.Unlock()
+
+	reg := Ctx.oseventRegistration()
+	Ctx.osTimeouts[reg] = t
+	t.timer = time.AfterFunc(time.Until(abs), func() {
+		Ctx.timeoutFire(reg)
+	})
+
+	return reg
+}
+
+func (Ctx *Context) timeoutModify(reg uintptr) {
+	Ctx.osMu.Lock()
+	defer Ctx.osMu.Unlock()
+
+	// If the timeout is already firing, this is a no-op.
+	if t, ok := Ctx.osTimeouts[reg]; ok {
+		t.timer.Reset(0)
+	}
+}
+
+func (Ctx *Context) timeoutFire(reg uintptr) {
+	Ctx.osMu.Lock()
+	t, ok := Ctx.osTimeouts[reg]
+	if ok {
+		// libxl implicitly deregisters the timeout when told
+		// that it occurred, which must happen only once.
+		delete(Ctx.osTimeouts, reg)
+	}
+	Ctx.osMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	Ctx.oseventOccurred(func() {
+		C.libxl_osevent_occurred_timeout(Ctx.ctx, t.forLibxl)
+	})
+}
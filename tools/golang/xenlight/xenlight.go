@@ -14,18 +14,86 @@
  * You should have received a copy of the GNU Lesser General Public
  * License along with this library; If not, see <http://www.gnu.org/licenses/>.
  */
+
+// Package xenlight is a Go binding for libxl.
+//
+// Methods which run long-running libxl operations, such as DomainPause,
+// DomainUnpause, DomainShutdown, DomainReboot, DomainDestroy,
+// DomainCreateNew and the Device*Add and Device*Remove methods, take an
+// *AsyncOp as their last argument. For all of them, nil runs the
+// operation synchronously, as these methods did before they took the
+// argument; existing callers only need to pass nil. See AsyncOp.
 package xenlight
 
 /*
 
 #cgo LDFLAGS: -lxenlight -lyajl -lxentoollog
 #include <stdlib.h>
+#include <stdint.h>
+#include <unistd.h>
 #include <libxl.h>
+#include <libxl_utils.h>
+
+// Implemented in callbacks.go.
+extern void xenlightChildprocForked(uintptr_t user, pid_t pid);
+
+// The pid of the Go process, recorded when fork_replacement is
+// installed.
+static pid_t xenlight_pid;
+
+static pid_t fork_replacement(void *user)
+{
+	pid_t pid;
+
+	// libxl also forks from within its own children, such as the
+	// middle process of libxl__spawn_spawn. Those are copies of the
+	// Go process without its threads, and must not call into Go.
+	if (getpid() != xenlight_pid)
+		return fork();
+
+	pid = fork();
+
+	// Nor may the child.
+	if (pid > 0)
+		xenlightChildprocForked((uintptr_t)user, pid);
 
-static const libxl_childproc_hooks childproc_hooks = { .chldowner = libxl_sigchld_owner_mainloop };
+	return pid;
+}
+
+static const libxl_childproc_hooks childproc_hooks_mainloop = { .chldowner = libxl_sigchld_owner_mainloop };
+static const libxl_childproc_hooks childproc_hooks_tracked = {
+	.chldowner = libxl_sigchld_owner_mainloop,
+	.fork_replacement = fork_replacement,
+};
+
+// libxl has no libxl_device_pci_list_free.
+static void xenlight_device_pci_list_free(libxl_device_pci *list, int num)
+{
+	int i;
+
+	for (i = 0; i < num; i++)
+		libxl_device_pci_dispose(&list[i]);
+	free(list);
+}
+
+// Nor libxl_device_channel_list_free.
+static void xenlight_device_channel_list_free(libxl_device_channel *list, int num)
+{
+	int i;
+
+	for (i = 0; i < num; i++)
+		libxl_device_channel_dispose(&list[i]);
+	free(list);
+}
 
-void xenlight_set_chldproc(libxl_ctx *ctx) {
-	libxl_childproc_setmode(ctx, &childproc_hooks, NULL);
+// If user is non-zero, the children libxl forks are reported to the
+// Context it refers to.
+void xenlight_set_chldproc(libxl_ctx *ctx, uintptr_t user) {
+	if (user) {
+		xenlight_pid = getpid();
+		libxl_childproc_setmode(ctx, &childproc_hooks_tracked, (void *)user);
+	} else
+		libxl_childproc_setmode(ctx, &childproc_hooks_mainloop, NULL);
 }
 
 */
@@ -40,10 +108,18 @@ import "C"
  */
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/cgo"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -85,42 +161,292 @@ func (e Error) Error() string {
 
 // Context represents a libxl_ctx.
 type Context struct {
-	ctx         *C.libxl_ctx
-	logger      *C.xentoollog_logger_stdiostream
-	sigchld     chan os.Signal
-	sigchldDone chan struct{}
+	ctx       *C.libxl_ctx
+	logger    *C.xentoollog_logger
+	logHandle cgo.Handle
+	childproc ChildprocMode
+
+	// Whether the Context uses the SIGCHLD dispatcher; see
+	// sigchldAttach. childClosed is protected by childMu.
+	sigchldAttached bool
+	childMu         sync.Mutex
+	childClosed     bool
+
+	// handle refers to the Context from C callbacks.
+	handle cgo.Handle
+
+	// Event delivery; see events.go.
+	evMu       sync.Mutex
+	evNext     uint64
+	evHandlers map[uint64]eventHandler
+	watchers   map[uint64]*eventWatcher
+	evKick     chan struct{}
+	evStop     chan struct{}
+	evDone     chan struct{}
+	evPoll     bool
+	evWake     [2]int
+	evWakeMu   sync.Mutex
+
+	// libxl fd and timeout registrations; see osevent.go.
+	osMu       sync.Mutex
+	osNext     uintptr
+	osFds      map[uintptr]*oseventFd
+	osTimeouts map[uintptr]*oseventTimeout
+	osLive     sync.RWMutex
+	osClosed   bool
+
+	// Outstanding asynchronous operations, by for_user value, and
+	// those run by goAsync.
+	aos    map[uint64]C.libxl_asyncop_how
+	goOps  map[*AsyncOp]context.CancelFunc
+	aoWait sync.WaitGroup
 }
 
 // Golang always unmasks SIGCHLD, and internally has ways of
 // distributing SIGCHLD to multiple recipients.  libxl has provision
-// for this model: just tell it when a SIGCHLD happened, and it will
-// look after its own processes.
+// for this model: tell it when one of its children has been reaped,
+// and it will look after the rest.
 //
 // This should "play nicely" with other users of SIGCHLD as long as
 // they don't reap libxl's processes.
 //
-// Every context needs to be notified on each SIGCHLD; so spin up a
-// new goroutine for each context.  If there are a large number of
-// contexts, this means each context will be woken up looking through
-// its own list of children.
+// libxl forks through the fork_replacement hook, which records which
+// Context each child belongs to.  A single goroutine, shared by all
+// Contexts, then waits for SIGCHLD, reaps those children which have
+// exited, and notifies only the libxl context that owns each of
+// them.  This way, a SIGCHLD does not wake up every Context.
+var sigchldDispatcher struct {
+	mu       sync.Mutex
+	users    int
+	children map[int]*Context
+	sigchld  chan os.Signal
+	kick     chan struct{}
+	done     chan struct{}
+}
+
+// sigchldAttach makes the SIGCHLD dispatcher reap the children of the
+// Context, starting the dispatcher if necessary.
+func (Ctx *Context) sigchldAttach() {
+	d := &sigchldDispatcher
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.users == 0 {
+		d.children = make(map[int]*Context)
+		d.sigchld = make(chan os.Signal, 2)
+		d.kick = make(chan struct{}, 1)
+		d.done = make(chan struct{})
+		signal.Notify(d.sigchld, syscall.SIGCHLD)
+
+		// This goroutine will run until d.sigchld is closed by
+		// the last sigchldDetach; at which point it will close
+		// d.done.
+		go sigchldHandler(d.sigchld, d.kick, d.done)
+	}
+	d.users++
+
+	Ctx.sigchldAttached = true
+}
+
+// sigchldDetach stops the SIGCHLD dispatcher from reaping the children of
+// the Context, stopping the dispatcher if this was the last Context
+// using it.
+func (Ctx *Context) sigchldDetach() {
+	d := &sigchldDispatcher
+
+	if !Ctx.sigchldAttached {
+		return
+	}
+	Ctx.sigchldAttached = false
+
+	d.mu.Lock()
+	for pid, ctx := range d.children {
+		if ctx == Ctx {
+			delete(d.children, pid)
+		}
+	}
+
+	var done chan struct{}
+	d.users--
+	if d.users == 0 {
+		signal.Stop(d.sigchld)
+		close(d.sigchld)
+		done = d.done
+		d.children = nil
+		d.sigchld = nil
+		d.kick = nil
+		d.done = nil
+	}
+	d.mu.Unlock()
+
+	// Wait for any notification in progress, before the context is
+	// freed.
+	Ctx.childMu.Lock()
+	Ctx.childClosed = true
+	Ctx.childMu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// childprocForked records that libxl forked pid on behalf of the Context.
+func (Ctx *Context) childprocForked(pid int) {
+	d := &sigchldDispatcher
+
+	d.mu.Lock()
+	d.children[pid] = Ctx
+	kick := d.kick
+	d.mu.Unlock()
+
+	// The child may have exited before it was recorded, in which case
+	// its SIGCHLD has been and gone.
+	select {
+	case kick <- struct{}{}:
+	default:
+	}
+}
+
+func sigchldHandler(sigchld <-chan os.Signal, kick <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case _, ok := <-sigchld:
+			if !ok {
+				return
+			}
+		case <-kick:
+		}
+
+		reapChildren()
+	}
+}
+
+// reapChildren reaps those children of libxl which have exited, and
+// tells the Context each belonged to.
+func reapChildren() {
+	type reaped struct {
+		ctx    *Context
+		pid    int
+		status syscall.WaitStatus
+	}
+
+	d := &sigchldDispatcher
+	var rs []reaped
+
+	d.mu.Lock()
+	for pid, ctx := range d.children {
+		var status syscall.WaitStatus
+
+		wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR || (err == nil && wpid != pid) {
+			// Still running; or try again on the next SIGCHLD.
+			continue
+		}
+		delete(d.children, pid)
+
+		// If the child was reaped by someone else, there is
+		// nothing to tell libxl.
+		if err == nil {
+			rs = append(rs, reaped{ctx, pid, status})
+		}
+	}
+	d.mu.Unlock()
+
+	// libxl may fork, and so call childprocForked, while holding the
+	// libxl context lock; so it must not be called with d.mu held.
+	for _, r := range rs {
+		r.ctx.childMu.Lock()
+		if !r.ctx.childClosed {
+			C.libxl_childproc_reaped(r.ctx.ctx, C.pid_t(r.pid), C.int(r.status))
+			r.ctx.kickEvents()
+		}
+		r.ctx.childMu.Unlock()
+	}
+}
+
+// ChildprocMode determines how the child processes libxl starts are
+// reaped.
 //
-// The alternate would be to register a fork callback, such that the
-// xenlight package can make a single list of all children, and only
-// notify the specific libxl context(s) that have children woken.  But
-// it's not clear to me this will be much more work than having the
-// xenlight go library do the same thing; doing it in separate go
-// threads has the potential to do it in parallel.  Leave that as an
-// optimization for later if it turns out to be a bottleneck.
-func sigchldHandler(ctx *Context) {
-	for _ = range ctx.sigchld {
-		C.libxl_childproc_sigchld_occurred(ctx.ctx)
+// libxl_sigchld_owner_libxl and libxl_sigchld_owner_libxl_always are
+// not offered: libxl requires SIGCHLD to be SIG_DFL or SIG_IGN when it
+// installs its own handler, and the Go runtime always installs one.
+type ChildprocMode int
+
+const (
+	// ChildprocModeMainloop has the package watch for SIGCHLD,
+	// and reap libxl's children itself. This is the default.
+	ChildprocModeMainloop ChildprocMode = iota
+
+	// ChildprocModeCustom leaves it to the application to watch for
+	// SIGCHLD, and to report it using ChildprocReaped or
+	// ChildprocSigchldOccurred.
+	ChildprocModeCustom
+)
+
+type contextOptions struct {
+	logger       Logger
+	logLevel     LogLevel
+	childproc    ChildprocMode
+	oseventHooks bool
+}
+
+// ContextOption is an option for NewContext.
+type ContextOption func(*contextOptions)
+
+// WithLogger has the Context pass messages logged by libxl on to
+// logger, instead of writing them to stderr.
+func WithLogger(logger Logger) ContextOption {
+	return func(o *contextOptions) {
+		o.logger = logger
+	}
+}
+
+// WithLogLevel sets the initial log level of the Context. The default
+// is LogLevelError.
+func WithLogLevel(level LogLevel) ContextOption {
+	return func(o *contextOptions) {
+		o.logLevel = level
+	}
+}
+
+// WithChildprocMode sets how the child processes libxl starts are
+// reaped. The default is ChildprocModeMainloop.
+func WithChildprocMode(mode ChildprocMode) ContextOption {
+	return func(o *contextOptions) {
+		o.childproc = mode
+	}
+}
+
+// WithOseventHooks sets whether libxl's fds and timeouts are serviced
+// through libxl_osevent_register_hooks, which is the default. Otherwise
+// a goroutine waits for them, using libxl_osevent_beforepoll and
+// libxl_osevent_afterpoll, for as long as the Context is open.
+func WithOseventHooks(enable bool) ContextOption {
+	return func(o *contextOptions) {
+		o.oseventHooks = enable
 	}
-	close(ctx.sigchldDone)
 }
 
 // NewContext returns a new Context.
-func NewContext() (ctx *Context, err error) {
+//
+// By default, the Context logs errors to stderr, reaps libxl's child
+// processes itself, and services libxl's fds and timeouts through
+// libxl_osevent_register_hooks. opts may change that.
+func NewContext(opts ...ContextOption) (ctx *Context, err error) {
+	o := contextOptions{
+		logLevel:     LogLevelError,
+		childproc:    ChildprocModeMainloop,
+		oseventHooks: true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	ctx = &Context{}
+	ctx.handle = cgo.NewHandle(ctx)
 
 	defer func() {
 		if err != nil {
@@ -130,44 +456,80 @@ func NewContext() (ctx *Context, err error) {
 	}()
 
 	// Create a logger
-	ctx.logger = C.xtl_createlogger_stdiostream(C.stderr, C.XTL_ERROR, 0)
+	if err = ctx.newLogger(o.logger, o.logLevel); err != nil {
+		return ctx, err
+	}
 
 	// Allocate a context
-	ret := C.libxl_ctx_alloc(&ctx.ctx, C.LIBXL_VERSION, 0,
-		(*C.xentoollog_logger)(unsafe.Pointer(ctx.logger)))
+	ret := C.libxl_ctx_alloc(&ctx.ctx, C.LIBXL_VERSION, 0, ctx.logger)
 	if ret != 0 {
 		return ctx, Error(ret)
 	}
 
-	// Tell libxl that we'll be dealing with SIGCHLD...
-	C.xenlight_set_chldproc(ctx.ctx)
+	// Have libxl's fds and timeouts serviced for us.
+	if err = ctx.startEvents(o.oseventHooks); err != nil {
+		return ctx, err
+	}
+
+	ctx.childproc = o.childproc
+	switch ctx.childproc {
+	case ChildprocModeMainloop:
+		// Tell libxl that we'll be dealing with SIGCHLD, and
+		// arrange to keep that promise.
+		ctx.sigchldAttach()
+		C.xenlight_set_chldproc(ctx.ctx, C.uintptr_t(ctx.handle))
 
-	// ...and arrange to keep that promise.
-	ctx.sigchld = make(chan os.Signal, 2)
-	ctx.sigchldDone = make(chan struct{}, 1)
-	signal.Notify(ctx.sigchld, syscall.SIGCHLD)
+	case ChildprocModeCustom:
+		C.xenlight_set_chldproc(ctx.ctx, 0)
 
-	// This goroutine will run until the ctx.sigchld is closed in
-	// ctx.Close(); at which point it will close ctx.sigchldDone.
-	go sigchldHandler(ctx)
+	default:
+		return ctx, fmt.Errorf("%v: unknown ChildprocMode %d", ErrorInval, o.childproc)
+	}
 
 	return ctx, nil
 }
 
-// Close closes the Context.
-func (ctx *Context) Close() error {
-	// Tell our SIGCHLD notifier to shut down, and wait for it to exit
-	// before we free the context.
-	if ctx.sigchld != nil {
-		signal.Stop(ctx.sigchld)
-		close(ctx.sigchld)
+// ChildprocReaped tells libxl that the child process pid has exited
+// with the given status, and been reaped. It may only be used with
+// ChildprocModeCustom. ErrorUnknownChild is returned if pid was not
+// started by libxl.
+func (Ctx *Context) ChildprocReaped(pid int, status syscall.WaitStatus) error {
+	if Ctx.childproc != ChildprocModeCustom {
+		return fmt.Errorf("%v: not using ChildprocModeCustom", ErrorInval)
+	}
 
-		<-ctx.sigchldDone
+	ret := C.libxl_childproc_reaped(Ctx.ctx, C.pid_t(pid), C.int(status))
+	Ctx.kickEvents()
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
 
-		ctx.sigchld = nil
-		ctx.sigchldDone = nil
+// ChildprocSigchldOccurred tells libxl that a SIGCHLD occurred, so that
+// it reaps any of its children which have exited. It may only be used
+// with ChildprocModeCustom.
+func (Ctx *Context) ChildprocSigchldOccurred() error {
+	if Ctx.childproc != ChildprocModeCustom {
+		return fmt.Errorf("%v: not using ChildprocModeCustom", ErrorInval)
 	}
 
+	C.libxl_childproc_sigchld_occurred(Ctx.ctx)
+	Ctx.kickEvents()
+
+	return nil
+}
+
+// Close closes the Context. Outstanding asynchronous operations are
+// aborted, and Close waits for them to complete.
+func (ctx *Context) Close() error {
+	ctx.stopEvents()
+
+	// Stop reaping our children, and wait for any notification in
+	// progress before we free the context.
+	ctx.sigchldDetach()
+
 	if ctx.ctx != nil {
 		ret := C.libxl_ctx_free(ctx.ctx)
 		if ret != 0 {
@@ -176,9 +538,11 @@ func (ctx *Context) Close() error {
 		ctx.ctx = nil
 	}
 
-	if ctx.logger != nil {
-		C.xtl_logger_destroy((*C.xentoollog_logger)(unsafe.Pointer(ctx.logger)))
-		ctx.logger = nil
+	ctx.destroyLogger()
+
+	if ctx.handle != 0 {
+		ctx.handle.Delete()
+		ctx.handle = 0
 	}
 
 	return nil
@@ -542,7 +906,7 @@ func SchedulerFromString(name string) (s Scheduler, err error) {
 
 	ret := C.libxl_scheduler_from_string(cname, &cs)
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -581,7 +945,7 @@ func (Ctx *Context) CpupoolInfo(Poolid uint32) (pool Cpupoolinfo, err error) {
 
 	ret := C.libxl_cpupool_info(Ctx.ctx, &c_cpupool, C.uint32_t(Poolid))
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 	defer C.libxl_cpupoolinfo_dispose(&c_cpupool)
@@ -615,7 +979,7 @@ func (Ctx *Context) CpupoolCreate(Name string, Scheduler Scheduler, Cpumap Bitma
 	ret := C.libxl_cpupool_create(Ctx.ctx, name, C.libxl_scheduler(Scheduler),
 		cbm, &uuid, &poolid)
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -628,7 +992,7 @@ func (Ctx *Context) CpupoolCreate(Name string, Scheduler Scheduler, Cpumap Bitma
 func (Ctx *Context) CpupoolDestroy(Poolid uint32) (err error) {
 	ret := C.libxl_cpupool_destroy(Ctx.ctx, C.uint32_t(Poolid))
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -639,7 +1003,7 @@ func (Ctx *Context) CpupoolDestroy(Poolid uint32) (err error) {
 func (Ctx *Context) CpupoolCpuadd(Poolid uint32, Cpu int) (err error) {
 	ret := C.libxl_cpupool_cpuadd(Ctx.ctx, C.uint32_t(Poolid), C.int(Cpu))
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -657,7 +1021,7 @@ func (Ctx *Context) CpupoolCpuaddCpumap(Poolid uint32, Cpumap Bitmap) (err error
 
 	ret := C.libxl_cpupool_cpuadd_cpumap(Ctx.ctx, C.uint32_t(Poolid), &cbm)
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -668,7 +1032,7 @@ func (Ctx *Context) CpupoolCpuaddCpumap(Poolid uint32, Cpumap Bitmap) (err error
 func (Ctx *Context) CpupoolCpuremove(Poolid uint32, Cpu int) (err error) {
 	ret := C.libxl_cpupool_cpuremove(Ctx.ctx, C.uint32_t(Poolid), C.int(Cpu))
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -686,7 +1050,7 @@ func (Ctx *Context) CpupoolCpuremoveCpumap(Poolid uint32, Cpumap Bitmap) (err er
 
 	ret := C.libxl_cpupool_cpuremove_cpumap(Ctx.ctx, C.uint32_t(Poolid), &cbm)
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -700,7 +1064,7 @@ func (Ctx *Context) CpupoolRename(Name string, Poolid uint32) (err error) {
 
 	ret := C.libxl_cpupool_rename(Ctx.ctx, name, C.uint32_t(Poolid))
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -713,7 +1077,7 @@ func (Ctx *Context) CpupoolCpuaddNode(Poolid uint32, Node int) (Cpus int, err er
 
 	ret := C.libxl_cpupool_cpuadd_node(Ctx.ctx, C.uint32_t(Poolid), C.int(Node), &ccpus)
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -728,7 +1092,7 @@ func (Ctx *Context) CpupoolCpuremoveNode(Poolid uint32, Node int) (Cpus int, err
 
 	ret := C.libxl_cpupool_cpuremove_node(Ctx.ctx, C.uint32_t(Poolid), C.int(Node), &ccpus)
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -741,13 +1105,126 @@ func (Ctx *Context) CpupoolCpuremoveNode(Poolid uint32, Node int) (Cpus int, err
 func (Ctx *Context) CpupoolMovedomain(Poolid uint32, Id Domid) (err error) {
 	ret := C.libxl_cpupool_movedomain(Ctx.ctx, C.uint32_t(Poolid), C.uint32_t(Id))
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
 	return
 }
 
+// cpupoolScheduler returns the scheduler of a cpupool.
+func (Ctx *Context) cpupoolScheduler(poolid uint32) (Scheduler, error) {
+	var cpool C.libxl_cpupoolinfo
+	C.libxl_cpupoolinfo_init(&cpool)
+	defer C.libxl_cpupoolinfo_dispose(&cpool)
+
+	ret := C.libxl_cpupool_info(Ctx.ctx, &cpool, C.uint32_t(poolid))
+	if ret != 0 {
+		return SchedulerUnknown, Error(ret)
+	}
+
+	return Scheduler(cpool.sched), nil
+}
+
+// checkCpupoolScheduler returns an error unless a cpupool uses sched.
+func (Ctx *Context) checkCpupoolScheduler(poolid uint32, sched Scheduler) error {
+	poolSched, err := Ctx.cpupoolScheduler(poolid)
+	if err != nil {
+		return err
+	}
+	if poolSched != sched {
+		return fmt.Errorf("%v: cpupool %v uses the %v scheduler, not %v", ErrorInval, poolid, poolSched, sched)
+	}
+
+	return nil
+}
+
+// SchedCreditParamsGet returns the parameters of the credit scheduler of
+// a cpupool.
+func (Ctx *Context) SchedCreditParamsGet(poolid uint32) (SchedCreditParams, error) {
+	var params SchedCreditParams
+
+	if err := Ctx.checkCpupoolScheduler(poolid, SchedulerCredit); err != nil {
+		return params, err
+	}
+
+	var cparams C.libxl_sched_credit_params
+	C.libxl_sched_credit_params_init(&cparams)
+
+	ret := C.libxl_sched_credit_params_get(Ctx.ctx, C.uint32_t(poolid), &cparams)
+	if ret != 0 {
+		return params, Error(ret)
+	}
+
+	err := params.fromC(&cparams)
+
+	return params, err
+}
+
+// SchedCreditParamsSet sets the parameters of the credit scheduler of a
+// cpupool. All the parameters are set, so params is usually obtained
+// from SchedCreditParamsGet first.
+func (Ctx *Context) SchedCreditParamsSet(poolid uint32, params *SchedCreditParams) error {
+	if err := Ctx.checkCpupoolScheduler(poolid, SchedulerCredit); err != nil {
+		return err
+	}
+
+	var cparams C.libxl_sched_credit_params
+	if err := params.toC(&cparams); err != nil {
+		return err
+	}
+
+	ret := C.libxl_sched_credit_params_set(Ctx.ctx, C.uint32_t(poolid), &cparams)
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
+// SchedCredit2ParamsGet returns the parameters of the credit2 scheduler
+// of a cpupool.
+func (Ctx *Context) SchedCredit2ParamsGet(poolid uint32) (SchedCredit2Params, error) {
+	var params SchedCredit2Params
+
+	if err := Ctx.checkCpupoolScheduler(poolid, SchedulerCredit2); err != nil {
+		return params, err
+	}
+
+	var cparams C.libxl_sched_credit2_params
+	C.libxl_sched_credit2_params_init(&cparams)
+
+	ret := C.libxl_sched_credit2_params_get(Ctx.ctx, C.uint32_t(poolid), &cparams)
+	if ret != 0 {
+		return params, Error(ret)
+	}
+
+	err := params.fromC(&cparams)
+
+	return params, err
+}
+
+// SchedCredit2ParamsSet sets the parameters of the credit2 scheduler of a
+// cpupool. All the parameters are set, so params is usually obtained
+// from SchedCredit2ParamsGet first.
+func (Ctx *Context) SchedCredit2ParamsSet(poolid uint32, params *SchedCredit2Params) error {
+	if err := Ctx.checkCpupoolScheduler(poolid, SchedulerCredit2); err != nil {
+		return err
+	}
+
+	var cparams C.libxl_sched_credit2_params
+	if err := params.toC(&cparams); err != nil {
+		return err
+	}
+
+	ret := C.libxl_sched_credit2_params_set(Ctx.ctx, C.uint32_t(poolid), &cparams)
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
 //
 // Utility functions
 //
@@ -780,6 +1257,225 @@ func (Ctx *Context) CpupoolMakeFree(Cpumap Bitmap) (err error) {
 	return
 }
 
+// CpupoolNumaSplit splits the CPUs of the host into one cpupool per NUMA
+// node, named Pool-node<N>, as xl cpupool-numa-split does. Pool-0 must be
+// the only cpupool.
+//
+// Pool-0 is kept, and renamed, for the node of CPU 0; if Domain-0 has
+// more vCPUs online than that node has CPUs, the extra vCPUs are taken
+// offline. The pools for the other nodes are created with the scheduler
+// of Pool-0. Other domains whose node affinity is a single one of those
+// nodes are moved to its pool; the rest stay in Pool-0, as they do with
+// xl. If a step fails, the steps already done are undone.
+func (Ctx *Context) CpupoolNumaSplit() (err error) {
+	pools := Ctx.ListCpupool()
+	if len(pools) != 1 {
+		return fmt.Errorf("%v: splitting not possible, already cpupools in use", ErrorInval)
+	}
+	pool0 := pools[0]
+
+	maxNodes, err := Ctx.GetMaxNodes()
+	if err != nil {
+		return fmt.Errorf("getting number of nodes: %v", err)
+	}
+
+	topology, err := Ctx.GetCpuTopology()
+	if err != nil {
+		return fmt.Errorf("getting CPU topology: %v", err)
+	}
+	if len(topology) == 0 || topology[0].Node == CputopologyInvalidEntry {
+		return fmt.Errorf("%v: CPU 0 has no node", ErrorInval)
+	}
+
+	nodeCpus := NodeCpumaps(topology)
+	if len(nodeCpus) > maxNodes {
+		return fmt.Errorf("%v: CPUs on node %v, but there are %v nodes", ErrorInval, len(nodeCpus)-1, maxNodes)
+	}
+
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if uerr := undo[i](); uerr != nil {
+				err = fmt.Errorf("%v (undoing split failed: %v)", err, uerr)
+			}
+		}
+	}()
+
+	// Give Pool-0 the CPUs of its node first, so that it is never
+	// left without CPUs.
+	first := int(topology[0].Node)
+
+	var added Bitmap
+	for cpu := 0; cpu <= nodeCpus[first].Max(); cpu++ {
+		if nodeCpus[first].Test(cpu) && !pool0.Cpumap.Test(cpu) {
+			added.Set(cpu)
+		}
+	}
+	if _, err = Ctx.CpupoolCpuaddNode(pool0.Poolid, first); err != nil {
+		return fmt.Errorf("adding CPUs of node %v to %v: %v", first, pool0.PoolName, err)
+	}
+	undo = append(undo, func() error {
+		return Ctx.CpupoolCpuremoveCpumap(pool0.Poolid, added)
+	})
+
+	if err = Ctx.CpupoolRename(fmt.Sprintf("Pool-node%d", first), pool0.Poolid); err != nil {
+		return fmt.Errorf("renaming %v: %v", pool0.PoolName, err)
+	}
+	undo = append(undo, func() error {
+		return Ctx.CpupoolRename(pool0.PoolName, pool0.Poolid)
+	})
+
+	if err = Ctx.cpupoolNumaSplitDom0(nodeCpus[first], &undo); err != nil {
+		return err
+	}
+
+	nodePools := make(map[int]uint32)
+	for node := range nodeCpus {
+		if node == first || nodeCpus[node].IsEmpty() {
+			continue
+		}
+
+		restore := nodeCpus[node].And(pool0.Cpumap)
+		if _, err = Ctx.CpupoolCpuremoveNode(pool0.Poolid, node); err != nil {
+			return fmt.Errorf("removing CPUs of node %v from %v: %v", node, pool0.PoolName, err)
+		}
+		undo = append(undo, func() error {
+			return Ctx.CpupoolCpuaddCpumap(pool0.Poolid, restore)
+		})
+
+		var poolid uint32
+		err, poolid = Ctx.CpupoolCreate(fmt.Sprintf("Pool-node%d", node), pool0.Sched, Bitmap{})
+		if err != nil {
+			return fmt.Errorf("creating cpupool for node %v: %v", node, err)
+		}
+		// Destroying the pool also frees its CPUs.
+		undo = append(undo, func() error {
+			return Ctx.CpupoolDestroy(poolid)
+		})
+
+		if _, err = Ctx.CpupoolCpuaddNode(poolid, node); err != nil {
+			return fmt.Errorf("adding CPUs of node %v to its cpupool: %v", node, err)
+		}
+		nodePools[node] = poolid
+	}
+
+	return Ctx.cpupoolNumaSplitDomains(pool0.Poolid, nodePools, &undo)
+}
+
+// cpupoolNumaSplitDomains moves the domains in the cpupool poolid whose
+// node affinity is a single node in nodePools to the cpupool of that
+// node, for CpupoolNumaSplit. It appends the steps undoing this to undo.
+func (Ctx *Context) cpupoolNumaSplitDomains(poolid uint32, nodePools map[int]uint32, undo *[]func() error) error {
+	for _, di := range Ctx.ListDomain() {
+		if di.Domid == 0 || di.Cpupool != poolid {
+			continue
+		}
+
+		nodes, err := Ctx.domainNodeaffinity(di.Domid)
+		if err != nil {
+			return fmt.Errorf("getting node affinity of domain %v: %v", di.Domid, err)
+		}
+
+		node := -1
+		for n := 0; n <= nodes.Max(); n++ {
+			if !nodes.Test(n) {
+				continue
+			}
+			if node >= 0 {
+				node = -1
+				break
+			}
+			node = n
+		}
+		target, ok := nodePools[node]
+		if !ok {
+			continue
+		}
+
+		domid := di.Domid
+		if err := Ctx.CpupoolMovedomain(target, domid); err != nil {
+			return fmt.Errorf("moving domain %v to the cpupool of node %v: %v", domid, node, err)
+		}
+		*undo = append(*undo, func() error {
+			return Ctx.CpupoolMovedomain(poolid, domid)
+		})
+	}
+
+	return nil
+}
+
+// domainNodeaffinity returns the NUMA node affinity of a domain.
+func (Ctx *Context) domainNodeaffinity(domid Domid) (Bitmap, error) {
+	var cnodemap C.libxl_bitmap
+	C.libxl_bitmap_init(&cnodemap)
+	defer C.libxl_bitmap_dispose(&cnodemap)
+
+	if ret := C.libxl_node_bitmap_alloc(Ctx.ctx, &cnodemap, 0); ret != 0 {
+		return Bitmap{}, Error(ret)
+	}
+	if ret := C.libxl_domain_get_nodeaffinity(Ctx.ctx, C.uint32_t(domid), &cnodemap); ret != 0 {
+		return Bitmap{}, Error(ret)
+	}
+
+	var nodes Bitmap
+	if err := nodes.fromC(&cnodemap); err != nil {
+		return Bitmap{}, err
+	}
+
+	return nodes, nil
+}
+
+// cpupoolNumaSplitDom0 takes vCPUs of Domain-0 offline until it has no
+// more online than there are CPUs in cpus, for CpupoolNumaSplit. It
+// appends the step undoing this to undo.
+func (Ctx *Context) cpupoolNumaSplitDom0(cpus Bitmap, undo *[]func() error) error {
+	n := 0
+	for cpu := 0; cpu <= cpus.Max(); cpu++ {
+		if cpus.Test(cpu) {
+			n++
+		}
+	}
+
+	var online Bitmap
+	nOnline := 0
+	for _, v := range Ctx.ListVcpu(0) {
+		if v.Online {
+			online.Set(int(v.Vcpuid))
+			nOnline++
+		}
+	}
+	if nOnline <= n {
+		return nil
+	}
+
+	var keep Bitmap
+	keep.SetRange(0, n-1)
+	if err := Ctx.SetVcpuonline(0, keep, nil); err != nil {
+		return fmt.Errorf("removing vCPUs of Domain-0: %v", err)
+	}
+	*undo = append(*undo, func() error {
+		return Ctx.SetVcpuonline(0, online, nil)
+	})
+
+	// The guest takes the vCPUs offline asynchronously.
+	for i := 0; ; i++ {
+		di, err := Ctx.DomainInfo(0)
+		if err != nil {
+			return fmt.Errorf("getting info for Domain-0: %v", err)
+		}
+		if int(di.VcpuOnline) <= n {
+			return nil
+		}
+		if i == 10 {
+			return fmt.Errorf("%v: Domain-0 failed to take vCPUs offline", ErrorFail)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
 /*
  * Bitmap operations
  */
@@ -902,7 +1598,7 @@ func (bm Bitmap) String() (s string) {
 func (Ctx *Context) GetMaxCpus() (maxCpus int, err error) {
 	ret := C.libxl_get_max_cpus(Ctx.ctx)
 	if ret < 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 	maxCpus = int(ret)
@@ -913,7 +1609,7 @@ func (Ctx *Context) GetMaxCpus() (maxCpus int, err error) {
 func (Ctx *Context) GetOnlineCpus() (onCpus int, err error) {
 	ret := C.libxl_get_online_cpus(Ctx.ctx)
 	if ret < 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 	onCpus = int(ret)
@@ -924,20 +1620,115 @@ func (Ctx *Context) GetOnlineCpus() (onCpus int, err error) {
 func (Ctx *Context) GetMaxNodes() (maxNodes int, err error) {
 	ret := C.libxl_get_max_nodes(Ctx.ctx)
 	if ret < 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 	maxNodes = int(ret)
 	return
 }
 
-//int libxl_get_free_memory(libxl_ctx *ctx, uint64_t *memkb);
-func (Ctx *Context) GetFreeMemory() (memkb uint64, err error) {
-	var cmem C.uint64_t
-	ret := C.libxl_get_free_memory(Ctx.ctx, &cmem)
+// The value of the fields of a Cputopology, Numainfo or Pcitopology
+// which are unknown, for example because the CPU is offline.
+const (
+	CputopologyInvalidEntry = C.LIBXL_CPUTOPOLOGY_INVALID_ENTRY
+	NumainfoInvalidEntry    = C.LIBXL_NUMAINFO_INVALID_ENTRY
+	PcitopologyInvalidEntry = C.LIBXL_PCITOPOLOGY_INVALID_ENTRY
+)
 
-	if ret < 0 {
-		err = Error(-ret)
+// GetCpuTopology returns the topology of each CPU of the host, indexed by
+// CPU number.
+func (Ctx *Context) GetCpuTopology() ([]Cputopology, error) {
+	var nbCpu C.int
+
+	clist := C.libxl_get_cpu_topology(Ctx.ctx, &nbCpu)
+	if clist == nil {
+		return nil, ErrorFail
+	}
+	defer C.libxl_cputopology_list_free(clist, nbCpu)
+
+	cs := (*[1 << 28]C.libxl_cputopology)(unsafe.Pointer(clist))[:nbCpu:nbCpu]
+	topology := make([]Cputopology, nbCpu)
+	for i := range cs {
+		if err := topology[i].fromC(&cs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return topology, nil
+}
+
+// NodeCpumaps returns the CPUs on each NUMA node, indexed by node, given
+// the topology returned by GetCpuTopology. CPUs on no known node are left
+// out.
+func NodeCpumaps(topology []Cputopology) []Bitmap {
+	var cpumaps []Bitmap
+
+	for cpu, t := range topology {
+		if t.Node == CputopologyInvalidEntry {
+			continue
+		}
+		if int(t.Node) >= len(cpumaps) {
+			cpumaps = append(cpumaps, make([]Bitmap, int(t.Node)+1-len(cpumaps))...)
+		}
+		cpumaps[t.Node].Set(cpu)
+	}
+
+	return cpumaps
+}
+
+// GetNumaInfo returns the memory of each NUMA node of the host, and the
+// distances from it to each node, indexed by node. Sizes are in bytes.
+func (Ctx *Context) GetNumaInfo() ([]Numainfo, error) {
+	var nr C.int
+
+	clist := C.libxl_get_numainfo(Ctx.ctx, &nr)
+	if clist == nil {
+		return nil, ErrorFail
+	}
+	defer C.libxl_numainfo_list_free(clist, nr)
+
+	cs := (*[1 << 28]C.libxl_numainfo)(unsafe.Pointer(clist))[:nr:nr]
+	info := make([]Numainfo, nr)
+	for i := range cs {
+		if err := info[i].fromC(&cs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// GetPciTopology returns the NUMA node of each PCI device of the host.
+func (Ctx *Context) GetPciTopology() ([]Pcitopology, error) {
+	var numDevs C.int
+
+	clist := C.libxl_get_pci_topology(Ctx.ctx, &numDevs)
+	if clist == nil {
+		if numDevs == 0 {
+			return nil, nil
+		}
+		return nil, ErrorFail
+	}
+	defer C.libxl_pcitopology_list_free(clist, numDevs)
+
+	cs := (*[1 << 28]C.libxl_pcitopology)(unsafe.Pointer(clist))[:numDevs:numDevs]
+	topology := make([]Pcitopology, numDevs)
+	for i := range cs {
+		if err := topology[i].fromC(&cs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return topology, nil
+}
+
+//int libxl_get_free_memory(libxl_ctx *ctx, uint64_t *memkb);
+func (Ctx *Context) GetFreeMemory() (memkb uint64, err error) {
+	var cmem C.uint64_t
+	ret := C.libxl_get_free_memory(Ctx.ctx, &cmem)
+
+	if ret < 0 {
+		err = Error(ret)
 		return
 	}
 
@@ -946,6 +1737,96 @@ func (Ctx *Context) GetFreeMemory() (memkb uint64, err error) {
 
 }
 
+// SetMemoryTarget sets the balloon target of a domain, in KiB. If relative
+// is true, targetMemkb is added to the current target instead, and may be
+// negative. If enforce is true, the maximum memory of the domain is
+// updated to match the new target as well.
+func (Ctx *Context) SetMemoryTarget(domid Domid, targetMemkb int64, relative, enforce bool) error {
+	var crelative, cenforce C.int
+	if relative {
+		crelative = 1
+	}
+	if enforce {
+		cenforce = 1
+	}
+
+	ret := C.libxl_set_memory_target(Ctx.ctx, C.uint32_t(domid), C.int64_t(targetMemkb), crelative, cenforce)
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
+// GetMemoryTarget returns the balloon target of a domain, in KiB.
+func (Ctx *Context) GetMemoryTarget(domid Domid) (uint64, error) {
+	var ctarget C.uint64_t
+
+	ret := C.libxl_get_memory_target(Ctx.ctx, C.uint32_t(domid), &ctarget)
+	if ret != 0 {
+		return 0, Error(ret)
+	}
+
+	return uint64(ctarget), nil
+}
+
+// DomainSetMaxmem sets the maximum amount of memory a domain may use, in
+// KiB.
+func (Ctx *Context) DomainSetMaxmem(domid Domid, maxMemkb uint64) error {
+	ret := C.libxl_domain_setmaxmem(Ctx.ctx, C.uint32_t(domid), C.uint64_t(maxMemkb))
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
+// DomainNeedMemory returns the amount of free host memory, in KiB, needed
+// to create a domain with the given configuration. config itself is not
+// modified.
+func (Ctx *Context) DomainNeedMemory(config *DomainConfig) (uint64, error) {
+	var cconfig C.libxl_domain_config
+	if err := config.toC(&cconfig); err != nil {
+		return 0, fmt.Errorf("converting domain config to C: %v", err)
+	}
+	defer C.libxl_domain_config_dispose(&cconfig)
+
+	var cneed C.uint64_t
+
+	ret := C.libxl_domain_need_memory(Ctx.ctx, &cconfig, ^C.uint32_t(0), &cneed)
+	if ret != 0 {
+		return 0, Error(ret)
+	}
+
+	return uint64(cneed), nil
+}
+
+// WaitForFreeMemory waits for at least memkb KiB of host memory to be
+// free, checking once a second for up to waitSecs seconds. domid is the
+// domain the memory is intended for. ErrorNomem is returned if the
+// memory is still not free when waitSecs expires.
+func (Ctx *Context) WaitForFreeMemory(domid Domid, memkb uint64, waitSecs int) error {
+	ret := C.libxl_wait_for_free_memory(Ctx.ctx, C.uint32_t(domid), C.uint64_t(memkb), C.int(waitSecs))
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
+// WaitForMemoryTarget waits for a domain to balloon down to its memory
+// target. The time the domain spends making progress towards the target
+// does not count against waitSecs. ErrorFail is returned if the target
+// has not been reached when waitSecs expires.
+func (Ctx *Context) WaitForMemoryTarget(domid Domid, waitSecs int) error {
+	ret := C.libxl_wait_for_memory_target(Ctx.ctx, C.uint32_t(domid), C.int(waitSecs))
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
 //int libxl_get_physinfo(libxl_ctx *ctx, libxl_physinfo *physinfo)
 func (Ctx *Context) GetPhysinfo() (physinfo *Physinfo, err error) {
 	var cphys C.libxl_physinfo
@@ -982,7 +1863,7 @@ func (Ctx *Context) DomainInfo(Id Domid) (di *Dominfo, err error) {
 	ret := C.libxl_domain_info(Ctx.ctx, &cdi, C.uint32_t(Id))
 
 	if ret != 0 {
-		err = Error(-ret)
+		err = Error(ret)
 		return
 	}
 
@@ -991,43 +1872,147 @@ func (Ctx *Context) DomainInfo(Id Domid) (di *Dominfo, err error) {
 	return
 }
 
-func (Ctx *Context) DomainUnpause(Id Domid) (err error) {
-	ret := C.libxl_domain_unpause(Ctx.ctx, C.uint32_t(Id), nil)
-
-	if ret != 0 {
-		err = Error(-ret)
-	}
-	return
+func (Ctx *Context) DomainUnpause(Id Domid, op *AsyncOp) (err error) {
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_domain_unpause(Ctx.ctx, C.uint32_t(Id), how)
+	}, nil)
 }
 
 //int libxl_domain_pause(libxl_ctx *ctx, uint32_t domain);
-func (Ctx *Context) DomainPause(id Domid) (err error) {
-	ret := C.libxl_domain_pause(Ctx.ctx, C.uint32_t(id), nil)
+func (Ctx *Context) DomainPause(id Domid, op *AsyncOp) (err error) {
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_domain_pause(Ctx.ctx, C.uint32_t(id), how)
+	}, nil)
+}
 
-	if ret != 0 {
-		err = Error(-ret)
+//int libxl_domain_shutdown(libxl_ctx *ctx, uint32_t domid);
+func (Ctx *Context) DomainShutdown(id Domid, op *AsyncOp) (err error) {
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_domain_shutdown(Ctx.ctx, C.uint32_t(id), how)
+	}, nil)
+}
+
+//int libxl_domain_reboot(libxl_ctx *ctx, uint32_t domid);
+func (Ctx *Context) DomainReboot(id Domid, op *AsyncOp) (err error) {
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_domain_reboot(Ctx.ctx, C.uint32_t(id), how)
+	}, nil)
+}
+
+// DomainResume resumes a domain which has been suspended, for example by
+// SaveDomain. If suspendCancel is true, co-operative resume is used,
+// which the guest must support: the guest sees the suspend as having
+// been cancelled.
+func (Ctx *Context) DomainResume(id Domid, suspendCancel bool, op *AsyncOp) error {
+	var csuspendCancel C.int
+	if suspendCancel {
+		csuspendCancel = 1
 	}
-	return
+
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_domain_resume(Ctx.ctx, C.uint32_t(id), csuspendCancel, how)
+	}, nil)
 }
 
-//int libxl_domain_shutdown(libxl_ctx *ctx, uint32_t domid);
-func (Ctx *Context) DomainShutdown(id Domid) (err error) {
-	ret := C.libxl_domain_shutdown(Ctx.ctx, C.uint32_t(id), nil)
+// DomainRename renames a domain. If oldName is not empty, the domain is
+// only renamed if it is currently called oldName.
+func (Ctx *Context) DomainRename(domid Domid, oldName, newName string) error {
+	var coldName *C.char
+	if oldName != "" {
+		coldName = C.CString(oldName)
+		defer C.free(unsafe.Pointer(coldName))
+	}
+	cnewName := C.CString(newName)
+	defer C.free(unsafe.Pointer(cnewName))
 
+	ret := C.libxl_domain_rename(Ctx.ctx, C.uint32_t(domid), coldName, cnewName)
 	if ret != 0 {
-		err = Error(-ret)
+		return Error(ret)
 	}
-	return
+
+	return nil
 }
 
-//int libxl_domain_reboot(libxl_ctx *ctx, uint32_t domid);
-func (Ctx *Context) DomainReboot(id Domid) (err error) {
-	ret := C.libxl_domain_reboot(Ctx.ctx, C.uint32_t(id), nil)
+// DomainDestroy destroys a domain.
+func (Ctx *Context) DomainDestroy(id Domid, op *AsyncOp) error {
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_domain_destroy(Ctx.ctx, C.uint32_t(id), how)
+	}, nil)
+}
 
-	if ret != 0 {
-		err = Error(-ret)
+// WatchDomainDeath reports the shutdown and death of a domain.
+//
+// EventTypeDomainShutdown and EventTypeDomainDeath events for the domain
+// are sent on the returned channel. A domain which is destroyed before
+// it shuts down may generate only an EventTypeDomainDeath event. The
+// channel is closed after the EventTypeDomainDeath event has been
+// received, or when the returned cancel function is called.
+func (Ctx *Context) WatchDomainDeath(id Domid) (events <-chan Event, cancel func(), err error) {
+	return Ctx.watchEvents(func(forUser C.libxl_ev_user) (C.int, func()) {
+		var evgen *C.libxl_evgen_domain_death
+
+		ret := C.libxl_evenable_domain_death(Ctx.ctx, C.uint32_t(id), forUser, &evgen)
+
+		return ret, func() {
+			C.libxl_evdisable_domain_death(Ctx.ctx, evgen)
+		}
+	}, func(ev *Event) bool {
+		return ev.Type == EventTypeDomainDeath
+	})
+}
+
+// WatchDiskEject reports media being ejected from a disk of a domain.
+//
+// The virtual device name and configuration of the disk are sent on the
+// returned channel each time the guest ejects the media in the disk with
+// the virtual device name vdev. The channel is closed when the returned
+// cancel function is called.
+func (Ctx *Context) WatchDiskEject(id Domid, vdev string) (ejects <-chan EventTypeUnionDiskEject, cancel func(), err error) {
+	events, cancelEvents, err := Ctx.watchEvents(func(forUser C.libxl_ev_user) (C.int, func()) {
+		var evgen *C.libxl_evgen_disk_eject
+
+		cvdev := C.CString(vdev)
+		defer C.free(unsafe.Pointer(cvdev))
+
+		ret := C.libxl_evenable_disk_eject(Ctx.ctx, C.uint32_t(id), cvdev, forUser, &evgen)
+
+		return ret, func() {
+			C.libxl_evdisable_disk_eject(Ctx.ctx, evgen)
+		}
+	}, nil)
+	if err != nil {
+		return nil, nil, err
 	}
-	return
+
+	c := make(chan EventTypeUnionDiskEject)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	go func() {
+		defer close(c)
+
+		for ev := range events {
+			eject, ok := ev.TypeUnion.(EventTypeUnionDiskEject)
+			if !ok {
+				continue
+			}
+
+			select {
+			case c <- eject:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	cancel = func() {
+		stopOnce.Do(func() {
+			close(stop)
+		})
+		cancelEvents()
+	}
+
+	return c, cancel, nil
 }
 
 //libxl_dominfo * libxl_list_domain(libxl_ctx*, int *nb_domain_out);
@@ -1075,53 +2060,64 @@ func (Ctx *Context) ListVcpu(id Domid) (glist []Vcpuinfo) {
 	return
 }
 
-func (ct ConsoleType) String() (str string) {
-	cstr := C.libxl_console_type_to_string(C.libxl_console_type(ct))
-	str = C.GoString(cstr)
+// SetVcpuonline sets which vCPUs of a domain are online: vCPU n is online
+// if bit n is set in cpumap, and offline otherwise. The number of bits
+// set must not exceed the maximum number of vCPUs of the domain.
+func (Ctx *Context) SetVcpuonline(domid Domid, cpumap Bitmap, op *AsyncOp) error {
+	ccpumap := (*C.libxl_bitmap)(C.calloc(1, C.sizeof_libxl_bitmap))
+	if err := cpumap.toC(ccpumap); err != nil {
+		C.free(unsafe.Pointer(ccpumap))
+		return err
+	}
 
-	return
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_set_vcpuonline(Ctx.ctx, C.uint32_t(domid), ccpumap, how)
+	}, func(op *AsyncOp) {
+		C.libxl_bitmap_dispose(ccpumap)
+		C.free(unsafe.Pointer(ccpumap))
+	})
 }
 
-//int libxl_console_get_tty(libxl_ctx *ctx, uint32_t domid, int cons_num,
-//libxl_console_type type, char **path);
-func (Ctx *Context) ConsoleGetTty(id Domid, consNum int, conType ConsoleType) (path string, err error) {
-	var cpath *C.char
-	ret := C.libxl_console_get_tty(Ctx.ctx, C.uint32_t(id), C.int(consNum), C.libxl_console_type(conType), &cpath)
-	if ret != 0 {
-		err = Error(-ret)
-		return
-	}
-	defer C.free(unsafe.Pointer(cpath))
+// affinityToC converts hard and soft CPU affinity maps to C. A nil map is
+// passed to libxl as NULL, which leaves that affinity unchanged. The
+// returned function frees the C maps.
+func affinityToC(hard, soft *Bitmap) (chard, csoft *C.libxl_bitmap, free func(), err error) {
+	var cmaps [2]C.libxl_bitmap
 
-	path = C.GoString(cpath)
-	return
-}
+	free = func() {
+		C.libxl_bitmap_dispose(&cmaps[0])
+		C.libxl_bitmap_dispose(&cmaps[1])
+	}
 
-//int libxl_primary_console_get_tty(libxl_ctx *ctx, uint32_t domid_vm,
-//					char **path);
-func (Ctx *Context) PrimaryConsoleGetTty(domid uint32) (path string, err error) {
-	var cpath *C.char
-	ret := C.libxl_primary_console_get_tty(Ctx.ctx, C.uint32_t(domid), &cpath)
-	if ret != 0 {
-		err = Error(-ret)
-		return
+	if hard != nil {
+		chard = &cmaps[0]
+		if err = hard.toC(chard); err != nil {
+			free()
+			return nil, nil, nil, err
+		}
+	}
+	if soft != nil {
+		csoft = &cmaps[1]
+		if err = soft.toC(csoft); err != nil {
+			free()
+			return nil, nil, nil, err
+		}
 	}
-	defer C.free(unsafe.Pointer(cpath))
 
-	path = C.GoString(cpath)
-	return
+	return chard, csoft, free, nil
 }
 
-// DeviceNicAdd adds a nic to a domain.
-func (Ctx *Context) DeviceNicAdd(domid Domid, nic *DeviceNic) error {
-	var cnic C.libxl_device_nic
-
-	if err := nic.toC(&cnic); err != nil {
+// SetVcpuaffinity sets the hard and soft CPU affinity of a vCPU of a
+// domain. Either map may be nil, to leave that affinity unchanged, but
+// not both.
+func (Ctx *Context) SetVcpuaffinity(domid Domid, vcpuid uint32, hard, soft *Bitmap) error {
+	chard, csoft, free, err := affinityToC(hard, soft)
+	if err != nil {
 		return err
 	}
-	defer C.libxl_device_nic_dispose(&cnic)
+	defer free()
 
-	ret := C.libxl_device_nic_add(Ctx.ctx, C.uint32_t(domid), &cnic, nil)
+	ret := C.libxl_set_vcpuaffinity(Ctx.ctx, C.uint32_t(domid), C.uint32_t(vcpuid), chard, csoft)
 	if ret != 0 {
 		return Error(ret)
 	}
@@ -1129,16 +2125,18 @@ func (Ctx *Context) DeviceNicAdd(domid Domid, nic *DeviceNic) error {
 	return nil
 }
 
-// DeviceNicRemove removes a nic from a domain.
-func (Ctx *Context) DeviceNicRemove(domid Domid, nic *DeviceNic) error {
-	var cnic C.libxl_device_nic
-
-	if err := nic.toC(&cnic); err != nil {
+// SetVcpuaffinityForce is like SetVcpuaffinity, but also overrides any
+// temporary affinity the guest has set for the vCPU. Unlike
+// SetVcpuaffinity, both maps may be nil, which only drops the temporary
+// affinity.
+func (Ctx *Context) SetVcpuaffinityForce(domid Domid, vcpuid uint32, hard, soft *Bitmap) error {
+	chard, csoft, free, err := affinityToC(hard, soft)
+	if err != nil {
 		return err
 	}
-	defer C.libxl_device_nic_dispose(&cnic)
+	defer free()
 
-	ret := C.libxl_device_nic_remove(Ctx.ctx, C.uint32_t(domid), &cnic, nil)
+	ret := C.libxl_set_vcpuaffinity_force(Ctx.ctx, C.uint32_t(domid), C.uint32_t(vcpuid), chard, csoft)
 	if ret != 0 {
 		return Error(ret)
 	}
@@ -1146,16 +2144,17 @@ func (Ctx *Context) DeviceNicRemove(domid Domid, nic *DeviceNic) error {
 	return nil
 }
 
-// DevicePciAdd is used to passthrough a PCI device to a domain.
-func (Ctx *Context) DevicePciAdd(domid Domid, pci *DevicePci) error {
-	var cpci C.libxl_device_pci
-
-	if err := pci.toC(&cpci); err != nil {
+// SetVcpuaffinityAll sets the hard and soft CPU affinity of vCPUs 0 to
+// maxVcpus-1 of a domain, as SetVcpuaffinity does. The remaining vCPUs
+// are still updated if setting the affinity of one of them fails.
+func (Ctx *Context) SetVcpuaffinityAll(domid Domid, maxVcpus uint, hard, soft *Bitmap) error {
+	chard, csoft, free, err := affinityToC(hard, soft)
+	if err != nil {
 		return err
 	}
-	defer C.libxl_device_pci_dispose(&cpci)
+	defer free()
 
-	ret := C.libxl_device_pci_add(Ctx.ctx, C.uint32_t(domid), &cpci, nil)
+	ret := C.libxl_set_vcpuaffinity_all(Ctx.ctx, C.uint32_t(domid), C.uint(maxVcpus), chard, csoft)
 	if ret != 0 {
 		return Error(ret)
 	}
@@ -1163,50 +2162,199 @@ func (Ctx *Context) DevicePciAdd(domid Domid, pci *DevicePci) error {
 	return nil
 }
 
-// DevicePciRemove removes a PCI device from a domain.
-func (Ctx *Context) DevicePciRemove(domid Domid, pci *DevicePci) error {
-	var cpci C.libxl_device_pci
+// SchedParam is a set of scheduling parameters, for DomainSchedParamsSet
+// and the like to set, named as the fields of DomainSchedParams and
+// SchedParams holding them.
+type SchedParam uint
 
-	if err := pci.toC(&cpci); err != nil {
-		return err
+const (
+	SchedParamWeight SchedParam = 1 << iota
+	SchedParamCap
+	SchedParamPeriod
+	SchedParamBudget
+	SchedParamExtratime
+
+	schedParamsAll = SchedParamExtratime<<1 - 1
+)
+
+var schedParamNames = []string{"Weight", "Cap", "Period", "Budget", "Extratime"}
+
+// String returns the names of the parameters in p, separated by "|".
+func (p SchedParam) String() string {
+	var names []string
+
+	for i, name := range schedParamNames {
+		if p&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if rest := p &^ schedParamsAll; rest != 0 {
+		names = append(names, fmt.Sprintf("SchedParam(%#x)", uint(rest)))
 	}
-	defer C.libxl_device_pci_dispose(&cpci)
 
-	ret := C.libxl_device_pci_remove(Ctx.ctx, C.uint32_t(domid), &cpci, nil)
-	if ret != 0 {
-		return Error(ret)
+	return strings.Join(names, "|")
+}
+
+// schedParamsUsed gives the parameters which each scheduler uses.
+var schedParamsUsed = map[Scheduler]SchedParam{
+	SchedulerCredit:   SchedParamWeight | SchedParamCap,
+	SchedulerCredit2:  SchedParamWeight | SchedParamCap,
+	SchedulerArinc653: 0,
+	SchedulerRtds:     SchedParamPeriod | SchedParamBudget | SchedParamExtratime,
+	SchedulerNull:     0,
+}
+
+// unusedSchedParams returns the parameters in set which sched does not
+// use. Schedulers libxl does not support are left for libxl to reject.
+func unusedSchedParams(sched Scheduler, set SchedParam) SchedParam {
+	used, known := schedParamsUsed[sched]
+	if !known {
+		used = schedParamsAll
 	}
 
-	return nil
+	return set &^ used
 }
 
-// DeviceUsbdevAdd adds a USB device to a domain.
-func (Ctx *Context) DeviceUsbdevAdd(domid Domid, usbdev *DeviceUsbdev) error {
-	var cusbdev C.libxl_device_usbdev
+// fields returns the fields of p holding each parameter.
+func (p *DomainSchedParams) fields() map[SchedParam]*int {
+	return map[SchedParam]*int{
+		SchedParamWeight:    &p.Weight,
+		SchedParamCap:       &p.Cap,
+		SchedParamPeriod:    &p.Period,
+		SchedParamBudget:    &p.Budget,
+		SchedParamExtratime: &p.Extratime,
+	}
+}
 
-	if err := usbdev.toC(&cusbdev); err != nil {
-		return err
+// fields returns the fields of p holding each parameter.
+func (p *SchedParams) fields() map[SchedParam]*int {
+	return map[SchedParam]*int{
+		SchedParamWeight:    &p.Weight,
+		SchedParamCap:       &p.Cap,
+		SchedParamPeriod:    &p.Period,
+		SchedParamBudget:    &p.Budget,
+		SchedParamExtratime: &p.Extratime,
+	}
+}
+
+// mergeSchedParams copies the parameters in set from src to dst, both as
+// returned by fields.
+func mergeSchedParams(dst, src map[SchedParam]*int, set SchedParam) {
+	for p, v := range dst {
+		if set&p != 0 {
+			*v = *src[p]
+		}
+	}
+}
+
+// domainSchedParamsToSet returns the parameters to pass to
+// libxl_domain_sched_params_set to set those in set to the values in
+// params. The others are left at the defaults, which libxl leaves
+// unchanged; the RTDS Extratime is the exception, as libxl takes any
+// value but 0 as turning it on.
+func domainSchedParamsToSet(params *DomainSchedParams, set SchedParam) DomainSchedParams {
+	p := DomainSchedParams{
+		Sched:     params.Sched,
+		Weight:    C.LIBXL_DOMAIN_SCHED_PARAM_WEIGHT_DEFAULT,
+		Cap:       C.LIBXL_DOMAIN_SCHED_PARAM_CAP_DEFAULT,
+		Period:    C.LIBXL_DOMAIN_SCHED_PARAM_PERIOD_DEFAULT,
+		Budget:    C.LIBXL_DOMAIN_SCHED_PARAM_BUDGET_DEFAULT,
+		Extratime: C.LIBXL_DOMAIN_SCHED_PARAM_EXTRATIME_DEFAULT,
+		Slice:     C.LIBXL_DOMAIN_SCHED_PARAM_SLICE_DEFAULT,
+		Latency:   C.LIBXL_DOMAIN_SCHED_PARAM_LATENCY_DEFAULT,
 	}
-	defer C.libxl_device_usbdev_dispose(&cusbdev)
+	mergeSchedParams(p.fields(), params.fields(), set)
+
+	return p
+}
 
-	ret := C.libxl_device_usbdev_add(Ctx.ctx, C.uint32_t(domid), &cusbdev, nil)
+// domainScheduler returns the scheduler of the cpupool a domain is in.
+func (Ctx *Context) domainScheduler(domid Domid) (Scheduler, error) {
+	var cdi C.libxl_dominfo
+	C.libxl_dominfo_init(&cdi)
+	defer C.libxl_dominfo_dispose(&cdi)
+
+	ret := C.libxl_domain_info(Ctx.ctx, &cdi, C.uint32_t(domid))
 	if ret != 0 {
-		return Error(ret)
+		return SchedulerUnknown, Error(ret)
 	}
 
-	return nil
+	return Ctx.cpupoolScheduler(uint32(cdi.cpupool))
 }
 
-// DeviceUsbdevRemove removes a USB device from a domain.
-func (Ctx *Context) DeviceUsbdevRemove(domid Domid, usbdev *DeviceUsbdev) error {
-	var cusbdev C.libxl_device_usbdev
+// DomainSchedParamsGet returns the scheduling parameters of a domain.
+// Parameters not used by the scheduler of the domain are left at their
+// defaults, as is the RTDS Extratime, which libxl only reports per vCPU.
+func (Ctx *Context) DomainSchedParamsGet(domid Domid) (DomainSchedParams, error) {
+	var params DomainSchedParams
+
+	var cparams C.libxl_domain_sched_params
+	C.libxl_domain_sched_params_init(&cparams)
+	defer C.libxl_domain_sched_params_dispose(&cparams)
 
-	if err := usbdev.toC(&cusbdev); err != nil {
+	ret := C.libxl_domain_sched_params_get(Ctx.ctx, C.uint32_t(domid), &cparams)
+	if ret != 0 {
+		return params, Error(ret)
+	}
+
+	err := params.fromC(&cparams)
+
+	return params, err
+}
+
+// schedParamsScheduler returns sched, or the scheduler of a domain if
+// sched is SchedulerUnknown, once it has checked that the scheduler uses
+// the parameters in set, and if vcpu is true, that it has per-vCPU
+// parameters.
+func (Ctx *Context) schedParamsScheduler(domid Domid, sched Scheduler, set SchedParam, vcpu bool) (Scheduler, error) {
+	if sched == SchedulerUnknown {
+		var err error
+		if sched, err = Ctx.domainScheduler(domid); err != nil {
+			return sched, err
+		}
+	}
+
+	if _, ok := schedParamsUsed[sched]; ok && vcpu && sched != SchedulerRtds {
+		return sched, fmt.Errorf("%v: the %v scheduler has no per-vCPU parameters", ErrorInval, sched)
+	}
+
+	if unused := unusedSchedParams(sched, set); unused != 0 {
+		return sched, fmt.Errorf("%v: %v not used by the %v scheduler", ErrorInval, unused, sched)
+	}
+
+	return sched, nil
+}
+
+// DomainSchedParamsSet sets the scheduling parameters in set of a domain
+// to the values in params, leaving the others unchanged. ErrorInval is
+// returned if params.Sched does not use all of them. If params.Sched is
+// SchedulerUnknown, the scheduler of the domain is used.
+//
+// libxl cannot leave the RTDS Extratime of a domain unchanged, so unless
+// set has all the RTDS parameters, they are set as by
+// VcpuSchedParamsSetAll, keeping those of each vCPU which are not in set.
+func (Ctx *Context) DomainSchedParamsSet(domid Domid, params *DomainSchedParams, set SchedParam) error {
+	sched, err := Ctx.schedParamsScheduler(domid, params.Sched, set, false)
+	if err != nil || set == 0 {
 		return err
 	}
-	defer C.libxl_device_usbdev_dispose(&cusbdev)
 
-	ret := C.libxl_device_usbdev_remove(Ctx.ctx, C.uint32_t(domid), &cusbdev, nil)
+	if sched == SchedulerRtds && set != schedParamsUsed[sched] {
+		var v SchedParams
+		mergeSchedParams(v.fields(), params.fields(), set)
+
+		return Ctx.vcpuSchedParamsSetAll(domid, sched, &v, set)
+	}
+
+	p := domainSchedParamsToSet(params, set)
+
+	var cparams C.libxl_domain_sched_params
+	if err := p.toC(&cparams); err != nil {
+		return err
+	}
+	defer C.libxl_domain_sched_params_dispose(&cparams)
+
+	ret := C.libxl_domain_sched_params_set(Ctx.ctx, C.uint32_t(domid), &cparams)
 	if ret != 0 {
 		return Error(ret)
 	}
@@ -1214,20 +2362,1312 @@ func (Ctx *Context) DeviceUsbdevRemove(domid Domid, usbdev *DeviceUsbdev) error
 	return nil
 }
 
-// DomainCreateNew creates a new domain.
-func (Ctx *Context) DomainCreateNew(config *DomainConfig) (Domid, error) {
-	var cdomid C.uint32_t
-	var cconfig C.libxl_domain_config
-	err := config.toC(&cconfig)
+// VcpuSchedParamsGet returns the scheduling parameters of the given vCPUs
+// of a domain. Only the RTDS scheduler has per-vCPU parameters.
+func (Ctx *Context) VcpuSchedParamsGet(domid Domid, vcpuids []int) (VcpuSchedParams, error) {
+	var params VcpuSchedParams
+
+	def, err := NewSchedParams()
 	if err != nil {
-		return Domid(0), fmt.Errorf("converting domain config to C: %v", err)
+		return params, err
 	}
-	defer C.libxl_domain_config_dispose(&cconfig)
+	params.Vcpus = make([]SchedParams, len(vcpuids))
+	for i, vcpuid := range vcpuids {
+		params.Vcpus[i] = *def
+		params.Vcpus[i].Vcpuid = vcpuid
+	}
+
+	var cparams C.libxl_vcpu_sched_params
+	if err := params.toC(&cparams); err != nil {
+		return params, err
+	}
+	defer C.libxl_vcpu_sched_params_dispose(&cparams)
 
-	ret := C.libxl_domain_create_new(Ctx.ctx, &cconfig, &cdomid, nil, nil)
+	ret := C.libxl_vcpu_sched_params_get(Ctx.ctx, C.uint32_t(domid), &cparams)
 	if ret != 0 {
-		return Domid(0), Error(ret)
+		return params, Error(ret)
 	}
 
-	return Domid(cdomid), nil
+	err = params.fromC(&cparams)
+
+	return params, err
+}
+
+// VcpuSchedParamsGetAll returns the scheduling parameters of all the
+// vCPUs of a domain. Only the RTDS scheduler has per-vCPU parameters.
+func (Ctx *Context) VcpuSchedParamsGetAll(domid Domid) (VcpuSchedParams, error) {
+	var params VcpuSchedParams
+
+	var cparams C.libxl_vcpu_sched_params
+	C.libxl_vcpu_sched_params_init(&cparams)
+	defer C.libxl_vcpu_sched_params_dispose(&cparams)
+
+	ret := C.libxl_vcpu_sched_params_get_all(Ctx.ctx, C.uint32_t(domid), &cparams)
+	if ret != 0 {
+		return params, Error(ret)
+	}
+
+	err := params.fromC(&cparams)
+
+	return params, err
+}
+
+// VcpuSchedParamsSet sets the scheduling parameters in set of vCPUs of a
+// domain, each entry of params.Vcpus applying to the vCPU given by its
+// Vcpuid, and leaves the others unchanged. set is checked as by
+// DomainSchedParamsSet; only the RTDS scheduler has per-vCPU parameters.
+func (Ctx *Context) VcpuSchedParamsSet(domid Domid, params *VcpuSchedParams, set SchedParam) error {
+	sched, err := Ctx.schedParamsScheduler(domid, params.Sched, set, true)
+	if err != nil || set == 0 {
+		return err
+	}
+
+	if set == schedParamsUsed[sched] {
+		return Ctx.vcpuSchedParamsSet(domid, params, false)
+	}
+
+	vcpuids := make([]int, len(params.Vcpus))
+	for i := range params.Vcpus {
+		vcpuids[i] = params.Vcpus[i].Vcpuid
+	}
+
+	cur, err := Ctx.VcpuSchedParamsGet(domid, vcpuids)
+	if err != nil {
+		return err
+	}
+	cur.Sched = sched
+	for i := range cur.Vcpus {
+		mergeSchedParams(cur.Vcpus[i].fields(), params.Vcpus[i].fields(), set)
+	}
+
+	return Ctx.vcpuSchedParamsSet(domid, &cur, false)
+}
+
+// VcpuSchedParamsSetAll sets the scheduling parameters in set of all the
+// vCPUs of a domain to the values in params.Vcpus[0], which must be the
+// only entry, and leaves the others unchanged. Its Vcpuid is ignored.
+// set is checked as by VcpuSchedParamsSet.
+func (Ctx *Context) VcpuSchedParamsSetAll(domid Domid, params *VcpuSchedParams, set SchedParam) error {
+	if len(params.Vcpus) != 1 {
+		return fmt.Errorf("%v: need exactly one set of vCPU parameters, got %v", ErrorInval, len(params.Vcpus))
+	}
+
+	sched, err := Ctx.schedParamsScheduler(domid, params.Sched, set, true)
+	if err != nil || set == 0 {
+		return err
+	}
+
+	return Ctx.vcpuSchedParamsSetAll(domid, sched, &params.Vcpus[0], set)
+}
+
+// vcpuSchedParamsSetAll is VcpuSchedParamsSetAll, once set has been
+// checked. libxl can only set all the parameters of all the vCPUs at
+// once, so unless set has all of those sched uses, they are set vCPU by
+// vCPU, merged into the current ones.
+func (Ctx *Context) vcpuSchedParamsSetAll(domid Domid, sched Scheduler, params *SchedParams, set SchedParam) error {
+	if set == schedParamsUsed[sched] {
+		return Ctx.vcpuSchedParamsSet(domid, &VcpuSchedParams{
+			Sched: sched,
+			Vcpus: []SchedParams{*params},
+		}, true)
+	}
+
+	cur, err := Ctx.VcpuSchedParamsGetAll(domid)
+	if err != nil {
+		return err
+	}
+	cur.Sched = sched
+	for i := range cur.Vcpus {
+		mergeSchedParams(cur.Vcpus[i].fields(), params.fields(), set)
+	}
+
+	return Ctx.vcpuSchedParamsSet(domid, &cur, false)
+}
+
+// vcpuSchedParamsSet passes params to libxl_vcpu_sched_params_set, or if
+// all is true, to libxl_vcpu_sched_params_set_all.
+func (Ctx *Context) vcpuSchedParamsSet(domid Domid, params *VcpuSchedParams, all bool) error {
+	var cparams C.libxl_vcpu_sched_params
+	if err := params.toC(&cparams); err != nil {
+		return err
+	}
+	defer C.libxl_vcpu_sched_params_dispose(&cparams)
+
+	var ret C.int
+	if all {
+		ret = C.libxl_vcpu_sched_params_set_all(Ctx.ctx, C.uint32_t(domid), &cparams)
+	} else {
+		ret = C.libxl_vcpu_sched_params_set(Ctx.ctx, C.uint32_t(domid), &cparams)
+	}
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
+func (ct ConsoleType) String() (str string) {
+	cstr := C.libxl_console_type_to_string(C.libxl_console_type(ct))
+	str = C.GoString(cstr)
+
+	return
+}
+
+//int libxl_console_get_tty(libxl_ctx *ctx, uint32_t domid, int cons_num,
+//libxl_console_type type, char **path);
+func (Ctx *Context) ConsoleGetTty(id Domid, consNum int, conType ConsoleType) (path string, err error) {
+	var cpath *C.char
+	ret := C.libxl_console_get_tty(Ctx.ctx, C.uint32_t(id), C.int(consNum), C.libxl_console_type(conType), &cpath)
+	if ret != 0 {
+		err = Error(ret)
+		return
+	}
+	defer C.free(unsafe.Pointer(cpath))
+
+	path = C.GoString(cpath)
+	return
+}
+
+//int libxl_primary_console_get_tty(libxl_ctx *ctx, uint32_t domid_vm,
+//					char **path);
+func (Ctx *Context) PrimaryConsoleGetTty(domid uint32) (path string, err error) {
+	var cpath *C.char
+	ret := C.libxl_primary_console_get_tty(Ctx.ctx, C.uint32_t(domid), &cpath)
+	if ret != 0 {
+		err = Error(ret)
+		return
+	}
+	defer C.free(unsafe.Pointer(cpath))
+
+	path = C.GoString(cpath)
+	return
+}
+
+// DeviceChannelList returns the channels of a domain.
+func (Ctx *Context) DeviceChannelList(domid Domid) ([]DeviceChannel, error) {
+	return deviceList[DeviceChannel](Ctx, domid, "channel", func(num *C.int) *C.libxl_device_channel {
+		return C.libxl_device_channel_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceChannelList)
+}
+
+// DeviceChannelGetInfo returns the state of the backend and frontend of a
+// channel of a domain. For a channel connected to a pty, its
+// ConnectionUnion is a ChannelinfoConnectionUnionPty giving the path of
+// the pty.
+func (Ctx *Context) DeviceChannelGetInfo(domid Domid, channel *DeviceChannel) (Channelinfo, error) {
+	var info Channelinfo
+
+	var cchannel C.libxl_device_channel
+	if err := channel.toC(&cchannel); err != nil {
+		return info, err
+	}
+	defer C.libxl_device_channel_dispose(&cchannel)
+
+	var cinfo C.libxl_channelinfo
+	C.libxl_channelinfo_init(&cinfo)
+	defer C.libxl_channelinfo_dispose(&cinfo)
+
+	ret := C.libxl_device_channel_getinfo(Ctx.ctx, C.uint32_t(domid), &cchannel, &cinfo)
+	if ret != 0 {
+		return info, Error(ret)
+	}
+
+	err := info.fromC(&cinfo)
+
+	return info, err
+}
+
+// ChannelGetTty returns the path of the pty that the channel called name
+// of a domain is connected to. ErrorNotfound is returned if the domain has
+// no such channel.
+func (Ctx *Context) ChannelGetTty(domid Domid, name string) (path string, err error) {
+	channels, err := Ctx.DeviceChannelList(domid)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range channels {
+		if channels[i].Name != name {
+			continue
+		}
+
+		if channels[i].Connection != ChannelConnectionPty {
+			return "", fmt.Errorf("%v: channel %q is not connected to a pty", ErrorInval, name)
+		}
+
+		info, err := Ctx.DeviceChannelGetInfo(domid, &channels[i])
+		if err != nil {
+			return "", err
+		}
+
+		pty, ok := info.ConnectionUnion.(ChannelinfoConnectionUnionPty)
+		if !ok || pty.Path == "" {
+			return "", fmt.Errorf("%v: channel %q has no pty yet", ErrorNotReady, name)
+		}
+
+		return pty.Path, nil
+	}
+
+	return "", ErrorNotfound
+}
+
+// deviceOp runs start, a libxl function which adds, removes or destroys
+// a device, as an asynchronous operation, passing it dev converted to C.
+// The C device is disposed of with dispose once the operation completes.
+func deviceOp[CT any](Ctx *Context, dev interface{ toC(*CT) error }, dispose func(*CT), start func(cdev *CT, how *C.libxl_asyncop_how) C.int, op *AsyncOp) error {
+	var zero CT
+	cdev := (*CT)(C.calloc(1, C.size_t(unsafe.Sizeof(zero))))
+
+	if err := dev.toC(cdev); err != nil {
+		C.free(unsafe.Pointer(cdev))
+		return err
+	}
+
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return start(cdev, how)
+	}, func(*AsyncOp) {
+		dispose(cdev)
+		C.free(unsafe.Pointer(cdev))
+	})
+}
+
+// deviceListError returns the error to report when a libxl device list
+// function has returned NULL for domid, with num devices. libxl returns
+// NULL both when the domain has no such devices and when listing them
+// fails, so check at least that the domain exists.
+func (Ctx *Context) deviceListError(domid Domid, num C.int) error {
+	if num != 0 {
+		return ErrorFail
+	}
+
+	var cdi C.libxl_dominfo
+	C.libxl_dominfo_init(&cdi)
+	defer C.libxl_dominfo_dispose(&cdi)
+
+	if ret := C.libxl_domain_info(Ctx.ctx, &cdi, C.uint32_t(domid)); ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
+// deviceList returns the devices of domid listed by list, a libxl device
+// list function, converted from C. The list is freed with free. what names
+// the kind of device, for errors.
+func deviceList[T any, CT any, PT interface {
+	*T
+	fromC(*CT) error
+}](Ctx *Context, domid Domid, what string, list func(num *C.int) *CT, free func(clist *CT, num C.int)) ([]T, error) {
+	var num C.int
+
+	clist := list(&num)
+	if clist == nil {
+		return nil, Ctx.deviceListError(domid, num)
+	}
+
+	return devicesFromC[T, CT, PT](clist, num, free, what)
+}
+
+// devicesFromC converts the num devices in clist from C, and frees clist
+// with free.
+func devicesFromC[T any, CT any, PT interface {
+	*T
+	fromC(*CT) error
+}](clist *CT, num C.int, free func(clist *CT, num C.int), what string) ([]T, error) {
+	defer free(clist, num)
+
+	cdevs := unsafe.Slice(clist, num)
+	devs := make([]T, len(cdevs))
+	for i := range cdevs {
+		if err := PT(&devs[i]).fromC(&cdevs[i]); err != nil {
+			return nil, fmt.Errorf("converting %s %d from C: %v", what, i, err)
+		}
+	}
+
+	return devs, nil
+}
+
+// Device dispose and list free functions, as func values for deviceOp
+// and deviceList.
+var (
+	disposeDeviceDisk  = func(c *C.libxl_device_disk) { C.libxl_device_disk_dispose(c) }
+	freeDeviceDiskList = func(l *C.libxl_device_disk, n C.int) { C.libxl_device_disk_list_free(l, n) }
+
+	disposeDeviceNic  = func(c *C.libxl_device_nic) { C.libxl_device_nic_dispose(c) }
+	freeDeviceNicList = func(l *C.libxl_device_nic, n C.int) { C.libxl_device_nic_list_free(l, n) }
+
+	disposeDevicePci  = func(c *C.libxl_device_pci) { C.libxl_device_pci_dispose(c) }
+	freeDevicePciList = func(l *C.libxl_device_pci, n C.int) { C.xenlight_device_pci_list_free(l, n) }
+
+	disposeDeviceUsbctrl  = func(c *C.libxl_device_usbctrl) { C.libxl_device_usbctrl_dispose(c) }
+	freeDeviceUsbctrlList = func(l *C.libxl_device_usbctrl, n C.int) { C.libxl_device_usbctrl_list_free(l, n) }
+
+	disposeDeviceUsbdev  = func(c *C.libxl_device_usbdev) { C.libxl_device_usbdev_dispose(c) }
+	freeDeviceUsbdevList = func(l *C.libxl_device_usbdev, n C.int) { C.libxl_device_usbdev_list_free(l, n) }
+
+	disposeDeviceVtpm  = func(c *C.libxl_device_vtpm) { C.libxl_device_vtpm_dispose(c) }
+	freeDeviceVtpmList = func(l *C.libxl_device_vtpm, n C.int) { C.libxl_device_vtpm_list_free(l, n) }
+
+	disposeDeviceVkb  = func(c *C.libxl_device_vkb) { C.libxl_device_vkb_dispose(c) }
+	freeDeviceVkbList = func(l *C.libxl_device_vkb, n C.int) { C.libxl_device_vkb_list_free(l, n) }
+
+	disposeDeviceVfb = func(c *C.libxl_device_vfb) { C.libxl_device_vfb_dispose(c) }
+
+	disposeDeviceVdispl  = func(c *C.libxl_device_vdispl) { C.libxl_device_vdispl_dispose(c) }
+	freeDeviceVdisplList = func(l *C.libxl_device_vdispl, n C.int) { C.libxl_device_vdispl_list_free(l, n) }
+
+	disposeDeviceVsnd  = func(c *C.libxl_device_vsnd) { C.libxl_device_vsnd_dispose(c) }
+	freeDeviceVsndList = func(l *C.libxl_device_vsnd, n C.int) { C.libxl_device_vsnd_list_free(l, n) }
+
+	freeDeviceChannelList = func(l *C.libxl_device_channel, n C.int) { C.xenlight_device_channel_list_free(l, n) }
+
+	disposeDeviceP9        = func(c *C.libxl_device_p9) { C.libxl_device_p9_dispose(c) }
+	disposeDevicePvcallsif = func(c *C.libxl_device_pvcallsif) { C.libxl_device_pvcallsif_dispose(c) }
+)
+
+// DeviceDiskAdd adds a disk to a domain.
+func (Ctx *Context) DeviceDiskAdd(domid Domid, disk *DeviceDisk, op *AsyncOp) error {
+	return deviceOp(Ctx, disk, disposeDeviceDisk, func(cdisk *C.libxl_device_disk, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_disk_add(Ctx.ctx, C.uint32_t(domid), cdisk, how)
+	}, op)
+}
+
+// DeviceDiskRemove removes a disk from a domain.
+func (Ctx *Context) DeviceDiskRemove(domid Domid, disk *DeviceDisk, op *AsyncOp) error {
+	return deviceOp(Ctx, disk, disposeDeviceDisk, func(cdisk *C.libxl_device_disk, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_disk_remove(Ctx.ctx, C.uint32_t(domid), cdisk, how)
+	}, op)
+}
+
+// DeviceDiskDestroy forcibly removes a disk from a domain, without waiting
+// for the guest to release it.
+func (Ctx *Context) DeviceDiskDestroy(domid Domid, disk *DeviceDisk, op *AsyncOp) error {
+	return deviceOp(Ctx, disk, disposeDeviceDisk, func(cdisk *C.libxl_device_disk, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_disk_destroy(Ctx.ctx, C.uint32_t(domid), cdisk, how)
+	}, op)
+}
+
+// DeviceDiskList returns the disks of a domain.
+func (Ctx *Context) DeviceDiskList(domid Domid) ([]DeviceDisk, error) {
+	return deviceList[DeviceDisk](Ctx, domid, "disk", func(num *C.int) *C.libxl_device_disk {
+		return C.libxl_device_disk_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceDiskList)
+}
+
+// DeviceDiskGetInfo returns the state of the backend and frontend of a disk
+// of a domain.
+func (Ctx *Context) DeviceDiskGetInfo(domid Domid, disk *DeviceDisk) (Diskinfo, error) {
+	var info Diskinfo
+
+	var cdisk C.libxl_device_disk
+	if err := disk.toC(&cdisk); err != nil {
+		return info, err
+	}
+	defer C.libxl_device_disk_dispose(&cdisk)
+
+	var cinfo C.libxl_diskinfo
+	C.libxl_diskinfo_init(&cinfo)
+	defer C.libxl_diskinfo_dispose(&cinfo)
+
+	ret := C.libxl_device_disk_getinfo(Ctx.ctx, C.uint32_t(domid), &cdisk, &cinfo)
+	if ret != 0 {
+		return info, Error(ret)
+	}
+
+	err := info.fromC(&cinfo)
+
+	return info, err
+}
+
+// CdromInsert inserts media into a CD-ROM drive of a domain, replacing any
+// media already in it. disk describes the new media; the drive, given by
+// disk.Vdev, must already be attached to the domain.
+func (Ctx *Context) CdromInsert(domid Domid, disk *DeviceDisk, op *AsyncOp) error {
+	return deviceOp(Ctx, disk, disposeDeviceDisk, func(cdisk *C.libxl_device_disk, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_cdrom_insert(Ctx.ctx, C.uint32_t(domid), cdisk, how)
+	}, op)
+}
+
+// CdromEject ejects the media from the CD-ROM drive vdev of a domain, by
+// inserting empty media in its place, as xl cd-eject does.
+func (Ctx *Context) CdromEject(domid Domid, vdev string, op *AsyncOp) error {
+	disk := &DeviceDisk{
+		Vdev:      vdev,
+		Format:    DiskFormatEmpty,
+		Removable: 1,
+		IsCdrom:   1,
+	}
+
+	return Ctx.CdromInsert(domid, disk, op)
+}
+
+// DeviceNicAdd adds a nic to a domain.
+func (Ctx *Context) DeviceNicAdd(domid Domid, nic *DeviceNic, op *AsyncOp) error {
+	return deviceOp(Ctx, nic, disposeDeviceNic, func(cnic *C.libxl_device_nic, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_nic_add(Ctx.ctx, C.uint32_t(domid), cnic, how)
+	}, op)
+}
+
+// DeviceNicRemove removes a nic from a domain.
+func (Ctx *Context) DeviceNicRemove(domid Domid, nic *DeviceNic, op *AsyncOp) error {
+	return deviceOp(Ctx, nic, disposeDeviceNic, func(cnic *C.libxl_device_nic, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_nic_remove(Ctx.ctx, C.uint32_t(domid), cnic, how)
+	}, op)
+}
+
+// DeviceNicDestroy forcibly removes a nic from a domain, without waiting
+// for the guest to release it.
+func (Ctx *Context) DeviceNicDestroy(domid Domid, nic *DeviceNic, op *AsyncOp) error {
+	return deviceOp(Ctx, nic, disposeDeviceNic, func(cnic *C.libxl_device_nic, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_nic_destroy(Ctx.ctx, C.uint32_t(domid), cnic, how)
+	}, op)
+}
+
+// DeviceNicList returns the nics of a domain.
+func (Ctx *Context) DeviceNicList(domid Domid) ([]DeviceNic, error) {
+	return deviceList[DeviceNic](Ctx, domid, "nic", func(num *C.int) *C.libxl_device_nic {
+		return C.libxl_device_nic_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceNicList)
+}
+
+// DeviceNicGetInfo returns the state of the backend and frontend of a nic
+// of a domain, including its event channel and ring references.
+func (Ctx *Context) DeviceNicGetInfo(domid Domid, nic *DeviceNic) (Nicinfo, error) {
+	var info Nicinfo
+
+	var cnic C.libxl_device_nic
+	if err := nic.toC(&cnic); err != nil {
+		return info, err
+	}
+	defer C.libxl_device_nic_dispose(&cnic)
+
+	var cinfo C.libxl_nicinfo
+	C.libxl_nicinfo_init(&cinfo)
+	defer C.libxl_nicinfo_dispose(&cinfo)
+
+	ret := C.libxl_device_nic_getinfo(Ctx.ctx, C.uint32_t(domid), &cnic, &cinfo)
+	if ret != 0 {
+		return info, Error(ret)
+	}
+
+	err := info.fromC(&cinfo)
+
+	return info, err
+}
+
+// DevicePciAdd is used to passthrough a PCI device to a domain.
+func (Ctx *Context) DevicePciAdd(domid Domid, pci *DevicePci, op *AsyncOp) error {
+	return deviceOp(Ctx, pci, disposeDevicePci, func(cpci *C.libxl_device_pci, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_add(Ctx.ctx, C.uint32_t(domid), cpci, how)
+	}, op)
+}
+
+// DevicePciRemove removes a PCI device from a domain.
+func (Ctx *Context) DevicePciRemove(domid Domid, pci *DevicePci, op *AsyncOp) error {
+	return deviceOp(Ctx, pci, disposeDevicePci, func(cpci *C.libxl_device_pci, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_remove(Ctx.ctx, C.uint32_t(domid), cpci, how)
+	}, op)
+}
+
+// DevicePciDestroy forcibly removes a PCI device from a domain, without
+// waiting for the guest to release it.
+func (Ctx *Context) DevicePciDestroy(domid Domid, pci *DevicePci, op *AsyncOp) error {
+	return deviceOp(Ctx, pci, disposeDevicePci, func(cpci *C.libxl_device_pci, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_destroy(Ctx.ctx, C.uint32_t(domid), cpci, how)
+	}, op)
+}
+
+// DevicePciList returns the PCI devices assigned to a domain.
+func (Ctx *Context) DevicePciList(domid Domid) ([]DevicePci, error) {
+	return deviceList[DevicePci](Ctx, domid, "PCI device", func(num *C.int) *C.libxl_device_pci {
+		return C.libxl_device_pci_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDevicePciList)
+}
+
+// DevicePciAssignableAdd makes a PCI device assignable to domains, by
+// binding it to pciback. If rebind is true, the driver the device is
+// currently bound to is recorded, so that DevicePciAssignableRemove can
+// hand the device back to it.
+func (Ctx *Context) DevicePciAssignableAdd(pci *DevicePci, rebind bool) error {
+	var cpci C.libxl_device_pci
+	if err := pci.toC(&cpci); err != nil {
+		return err
+	}
+	defer C.libxl_device_pci_dispose(&cpci)
+
+	var crebind C.int
+	if rebind {
+		crebind = 1
+	}
+
+	ret := C.libxl_device_pci_assignable_add(Ctx.ctx, &cpci, crebind)
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
+// DevicePciAssignableRemove unbinds a PCI device from pciback. If rebind
+// is true, the device is bound back to the driver recorded by
+// DevicePciAssignableAdd.
+func (Ctx *Context) DevicePciAssignableRemove(pci *DevicePci, rebind bool) error {
+	var cpci C.libxl_device_pci
+	if err := pci.toC(&cpci); err != nil {
+		return err
+	}
+	defer C.libxl_device_pci_dispose(&cpci)
+
+	var crebind C.int
+	if rebind {
+		crebind = 1
+	}
+
+	ret := C.libxl_device_pci_assignable_remove(Ctx.ctx, &cpci, crebind)
+	if ret != 0 {
+		return Error(ret)
+	}
+
+	return nil
+}
+
+// DevicePciAssignableList returns the PCI devices which are assignable to
+// domains.
+func (Ctx *Context) DevicePciAssignableList() ([]DevicePci, error) {
+	var num C.int
+
+	clist := C.libxl_device_pci_assignable_list(Ctx.ctx, &num)
+	if clist == nil {
+		if num != 0 {
+			return nil, ErrorFail
+		}
+		// libxl also returns NULL if pciback is not loaded, as it
+		// then cannot tell which devices are assignable.
+		if _, err := os.Stat("/sys/bus/pci/drivers/pciback"); err != nil {
+			return nil, fmt.Errorf("%v: pciback driver not loaded: %v", ErrorFail, err)
+		}
+		return nil, nil
+	}
+
+	return devicesFromC[DevicePci](clist, num, freeDevicePciList, "PCI device")
+}
+
+// DeviceUsbctrlAdd adds a USB controller to a domain.
+func (Ctx *Context) DeviceUsbctrlAdd(domid Domid, usbctrl *DeviceUsbctrl, op *AsyncOp) error {
+	return deviceOp(Ctx, usbctrl, disposeDeviceUsbctrl, func(cusbctrl *C.libxl_device_usbctrl, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbctrl_add(Ctx.ctx, C.uint32_t(domid), cusbctrl, how)
+	}, op)
+}
+
+// DeviceUsbctrlRemove removes a USB controller, and the USB devices attached
+// to it, from a domain.
+func (Ctx *Context) DeviceUsbctrlRemove(domid Domid, usbctrl *DeviceUsbctrl, op *AsyncOp) error {
+	return deviceOp(Ctx, usbctrl, disposeDeviceUsbctrl, func(cusbctrl *C.libxl_device_usbctrl, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbctrl_remove(Ctx.ctx, C.uint32_t(domid), cusbctrl, how)
+	}, op)
+}
+
+// DeviceUsbctrlDestroy forcibly removes a USB controller, and the USB devices
+// attached to it, from a domain, without waiting for the guest to release
+// them.
+func (Ctx *Context) DeviceUsbctrlDestroy(domid Domid, usbctrl *DeviceUsbctrl, op *AsyncOp) error {
+	return deviceOp(Ctx, usbctrl, disposeDeviceUsbctrl, func(cusbctrl *C.libxl_device_usbctrl, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbctrl_destroy(Ctx.ctx, C.uint32_t(domid), cusbctrl, how)
+	}, op)
+}
+
+// DeviceUsbctrlList returns the USB controllers of a domain.
+func (Ctx *Context) DeviceUsbctrlList(domid Domid) ([]DeviceUsbctrl, error) {
+	return deviceList[DeviceUsbctrl](Ctx, domid, "USB controller", func(num *C.int) *C.libxl_device_usbctrl {
+		return C.libxl_device_usbctrl_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceUsbctrlList)
+}
+
+// DeviceUsbctrlGetInfo returns the state of a USB controller of a domain,
+// including its number of ports.
+func (Ctx *Context) DeviceUsbctrlGetInfo(domid Domid, usbctrl *DeviceUsbctrl) (Usbctrlinfo, error) {
+	var info Usbctrlinfo
+
+	var cusbctrl C.libxl_device_usbctrl
+	if err := usbctrl.toC(&cusbctrl); err != nil {
+		return info, err
+	}
+	defer C.libxl_device_usbctrl_dispose(&cusbctrl)
+
+	var cinfo C.libxl_usbctrlinfo
+	C.libxl_usbctrlinfo_init(&cinfo)
+	defer C.libxl_usbctrlinfo_dispose(&cinfo)
+
+	ret := C.libxl_device_usbctrl_getinfo(Ctx.ctx, C.uint32_t(domid), &cusbctrl, &cinfo)
+	if ret != 0 {
+		return info, Error(ret)
+	}
+
+	err := info.fromC(&cinfo)
+
+	return info, err
+}
+
+// DeviceUsbdevAdd adds a USB device to a domain.
+func (Ctx *Context) DeviceUsbdevAdd(domid Domid, usbdev *DeviceUsbdev, op *AsyncOp) error {
+	return deviceOp(Ctx, usbdev, disposeDeviceUsbdev, func(cusbdev *C.libxl_device_usbdev, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbdev_add(Ctx.ctx, C.uint32_t(domid), cusbdev, how)
+	}, op)
+}
+
+// DeviceUsbdevRemove removes a USB device from a domain.
+func (Ctx *Context) DeviceUsbdevRemove(domid Domid, usbdev *DeviceUsbdev, op *AsyncOp) error {
+	return deviceOp(Ctx, usbdev, disposeDeviceUsbdev, func(cusbdev *C.libxl_device_usbdev, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbdev_remove(Ctx.ctx, C.uint32_t(domid), cusbdev, how)
+	}, op)
+}
+
+// DeviceUsbdevList returns the USB devices of a domain, across all of its
+// USB controllers.
+func (Ctx *Context) DeviceUsbdevList(domid Domid) ([]DeviceUsbdev, error) {
+	return deviceList[DeviceUsbdev](Ctx, domid, "USB device", func(num *C.int) *C.libxl_device_usbdev {
+		return C.libxl_device_usbdev_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceUsbdevList)
+}
+
+// DeviceVtpmAdd adds a vTPM to a domain.
+func (Ctx *Context) DeviceVtpmAdd(domid Domid, vtpm *DeviceVtpm, op *AsyncOp) error {
+	return deviceOp(Ctx, vtpm, disposeDeviceVtpm, func(cvtpm *C.libxl_device_vtpm, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vtpm_add(Ctx.ctx, C.uint32_t(domid), cvtpm, how)
+	}, op)
+}
+
+// DeviceVtpmRemove removes a vTPM from a domain.
+func (Ctx *Context) DeviceVtpmRemove(domid Domid, vtpm *DeviceVtpm, op *AsyncOp) error {
+	return deviceOp(Ctx, vtpm, disposeDeviceVtpm, func(cvtpm *C.libxl_device_vtpm, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vtpm_remove(Ctx.ctx, C.uint32_t(domid), cvtpm, how)
+	}, op)
+}
+
+// DeviceVtpmDestroy forcibly removes a vTPM from a domain, without waiting
+// for the guest to release it.
+func (Ctx *Context) DeviceVtpmDestroy(domid Domid, vtpm *DeviceVtpm, op *AsyncOp) error {
+	return deviceOp(Ctx, vtpm, disposeDeviceVtpm, func(cvtpm *C.libxl_device_vtpm, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vtpm_destroy(Ctx.ctx, C.uint32_t(domid), cvtpm, how)
+	}, op)
+}
+
+// DeviceVtpmList returns the vTPMs of a domain.
+func (Ctx *Context) DeviceVtpmList(domid Domid) ([]DeviceVtpm, error) {
+	return deviceList[DeviceVtpm](Ctx, domid, "vTPM", func(num *C.int) *C.libxl_device_vtpm {
+		return C.libxl_device_vtpm_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceVtpmList)
+}
+
+// DeviceVtpmGetInfo returns the state of the backend and frontend of a vTPM
+// of a domain, and its UUID.
+func (Ctx *Context) DeviceVtpmGetInfo(domid Domid, vtpm *DeviceVtpm) (Vtpminfo, error) {
+	var info Vtpminfo
+
+	var cvtpm C.libxl_device_vtpm
+	if err := vtpm.toC(&cvtpm); err != nil {
+		return info, err
+	}
+	defer C.libxl_device_vtpm_dispose(&cvtpm)
+
+	var cinfo C.libxl_vtpminfo
+	C.libxl_vtpminfo_init(&cinfo)
+	defer C.libxl_vtpminfo_dispose(&cinfo)
+
+	ret := C.libxl_device_vtpm_getinfo(Ctx.ctx, C.uint32_t(domid), &cvtpm, &cinfo)
+	if ret != 0 {
+		return info, Error(ret)
+	}
+
+	err := info.fromC(&cinfo)
+
+	return info, err
+}
+
+// DeviceVkbAdd adds a virtual keyboard to a domain.
+func (Ctx *Context) DeviceVkbAdd(domid Domid, vkb *DeviceVkb, op *AsyncOp) error {
+	return deviceOp(Ctx, vkb, disposeDeviceVkb, func(cvkb *C.libxl_device_vkb, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vkb_add(Ctx.ctx, C.uint32_t(domid), cvkb, how)
+	}, op)
+}
+
+// DeviceVkbRemove removes a virtual keyboard from a domain.
+func (Ctx *Context) DeviceVkbRemove(domid Domid, vkb *DeviceVkb, op *AsyncOp) error {
+	return deviceOp(Ctx, vkb, disposeDeviceVkb, func(cvkb *C.libxl_device_vkb, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vkb_remove(Ctx.ctx, C.uint32_t(domid), cvkb, how)
+	}, op)
+}
+
+// DeviceVkbDestroy forcibly removes a virtual keyboard from a domain,
+// without waiting for the guest to release it.
+func (Ctx *Context) DeviceVkbDestroy(domid Domid, vkb *DeviceVkb, op *AsyncOp) error {
+	return deviceOp(Ctx, vkb, disposeDeviceVkb, func(cvkb *C.libxl_device_vkb, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vkb_destroy(Ctx.ctx, C.uint32_t(domid), cvkb, how)
+	}, op)
+}
+
+// DeviceVkbList returns the virtual keyboards of a domain.
+func (Ctx *Context) DeviceVkbList(domid Domid) ([]DeviceVkb, error) {
+	return deviceList[DeviceVkb](Ctx, domid, "virtual keyboard", func(num *C.int) *C.libxl_device_vkb {
+		return C.libxl_device_vkb_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceVkbList)
+}
+
+// DeviceVkbGetInfo returns the state of the backend and frontend of a
+// virtual keyboard of a domain.
+func (Ctx *Context) DeviceVkbGetInfo(domid Domid, vkb *DeviceVkb) (Vkbinfo, error) {
+	var info Vkbinfo
+
+	var cvkb C.libxl_device_vkb
+	if err := vkb.toC(&cvkb); err != nil {
+		return info, err
+	}
+	defer C.libxl_device_vkb_dispose(&cvkb)
+
+	var cinfo C.libxl_vkbinfo
+	C.libxl_vkbinfo_init(&cinfo)
+	defer C.libxl_vkbinfo_dispose(&cinfo)
+
+	ret := C.libxl_device_vkb_getinfo(Ctx.ctx, C.uint32_t(domid), &cvkb, &cinfo)
+	if ret != 0 {
+		return info, Error(ret)
+	}
+
+	err := info.fromC(&cinfo)
+
+	return info, err
+}
+
+// DeviceVfbAdd adds a virtual framebuffer to a domain.
+func (Ctx *Context) DeviceVfbAdd(domid Domid, vfb *DeviceVfb, op *AsyncOp) error {
+	return deviceOp(Ctx, vfb, disposeDeviceVfb, func(cvfb *C.libxl_device_vfb, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vfb_add(Ctx.ctx, C.uint32_t(domid), cvfb, how)
+	}, op)
+}
+
+// DeviceVfbRemove removes a virtual framebuffer from a domain.
+func (Ctx *Context) DeviceVfbRemove(domid Domid, vfb *DeviceVfb, op *AsyncOp) error {
+	return deviceOp(Ctx, vfb, disposeDeviceVfb, func(cvfb *C.libxl_device_vfb, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vfb_remove(Ctx.ctx, C.uint32_t(domid), cvfb, how)
+	}, op)
+}
+
+// DeviceVfbDestroy forcibly removes a virtual framebuffer from a domain,
+// without waiting for the guest to release it.
+func (Ctx *Context) DeviceVfbDestroy(domid Domid, vfb *DeviceVfb, op *AsyncOp) error {
+	return deviceOp(Ctx, vfb, disposeDeviceVfb, func(cvfb *C.libxl_device_vfb, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vfb_destroy(Ctx.ctx, C.uint32_t(domid), cvfb, how)
+	}, op)
+}
+
+// DeviceVdisplAdd adds a virtual display to a domain.
+func (Ctx *Context) DeviceVdisplAdd(domid Domid, vdispl *DeviceVdispl, op *AsyncOp) error {
+	return deviceOp(Ctx, vdispl, disposeDeviceVdispl, func(cvdispl *C.libxl_device_vdispl, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vdispl_add(Ctx.ctx, C.uint32_t(domid), cvdispl, how)
+	}, op)
+}
+
+// DeviceVdisplRemove removes a virtual display from a domain.
+func (Ctx *Context) DeviceVdisplRemove(domid Domid, vdispl *DeviceVdispl, op *AsyncOp) error {
+	return deviceOp(Ctx, vdispl, disposeDeviceVdispl, func(cvdispl *C.libxl_device_vdispl, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vdispl_remove(Ctx.ctx, C.uint32_t(domid), cvdispl, how)
+	}, op)
+}
+
+// DeviceVdisplDestroy forcibly removes a virtual display from a domain,
+// without waiting for the guest to release it.
+func (Ctx *Context) DeviceVdisplDestroy(domid Domid, vdispl *DeviceVdispl, op *AsyncOp) error {
+	return deviceOp(Ctx, vdispl, disposeDeviceVdispl, func(cvdispl *C.libxl_device_vdispl, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vdispl_destroy(Ctx.ctx, C.uint32_t(domid), cvdispl, how)
+	}, op)
+}
+
+// DeviceVdisplList returns the virtual displays of a domain.
+func (Ctx *Context) DeviceVdisplList(domid Domid) ([]DeviceVdispl, error) {
+	return deviceList[DeviceVdispl](Ctx, domid, "virtual display", func(num *C.int) *C.libxl_device_vdispl {
+		return C.libxl_device_vdispl_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceVdisplList)
+}
+
+// DeviceVdisplGetInfo returns the state of the backend and frontend of a
+// virtual display of a domain, and of each of its connectors.
+func (Ctx *Context) DeviceVdisplGetInfo(domid Domid, vdispl *DeviceVdispl) (Vdisplinfo, error) {
+	var info Vdisplinfo
+
+	var cvdispl C.libxl_device_vdispl
+	if err := vdispl.toC(&cvdispl); err != nil {
+		return info, err
+	}
+	defer C.libxl_device_vdispl_dispose(&cvdispl)
+
+	var cinfo C.libxl_vdisplinfo
+	C.libxl_vdisplinfo_init(&cinfo)
+	defer C.libxl_vdisplinfo_dispose(&cinfo)
+
+	ret := C.libxl_device_vdispl_getinfo(Ctx.ctx, C.uint32_t(domid), &cvdispl, &cinfo)
+	if ret != 0 {
+		return info, Error(ret)
+	}
+
+	err := info.fromC(&cinfo)
+
+	return info, err
+}
+
+// DeviceVsndAdd adds a virtual sound card to a domain.
+func (Ctx *Context) DeviceVsndAdd(domid Domid, vsnd *DeviceVsnd, op *AsyncOp) error {
+	return deviceOp(Ctx, vsnd, disposeDeviceVsnd, func(cvsnd *C.libxl_device_vsnd, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vsnd_add(Ctx.ctx, C.uint32_t(domid), cvsnd, how)
+	}, op)
+}
+
+// DeviceVsndRemove removes a virtual sound card from a domain.
+func (Ctx *Context) DeviceVsndRemove(domid Domid, vsnd *DeviceVsnd, op *AsyncOp) error {
+	return deviceOp(Ctx, vsnd, disposeDeviceVsnd, func(cvsnd *C.libxl_device_vsnd, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vsnd_remove(Ctx.ctx, C.uint32_t(domid), cvsnd, how)
+	}, op)
+}
+
+// DeviceVsndDestroy forcibly removes a virtual sound card from a domain,
+// without waiting for the guest to release it.
+func (Ctx *Context) DeviceVsndDestroy(domid Domid, vsnd *DeviceVsnd, op *AsyncOp) error {
+	return deviceOp(Ctx, vsnd, disposeDeviceVsnd, func(cvsnd *C.libxl_device_vsnd, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_vsnd_destroy(Ctx.ctx, C.uint32_t(domid), cvsnd, how)
+	}, op)
+}
+
+// DeviceVsndList returns the virtual sound cards of a domain.
+func (Ctx *Context) DeviceVsndList(domid Domid) ([]DeviceVsnd, error) {
+	return deviceList[DeviceVsnd](Ctx, domid, "virtual sound card", func(num *C.int) *C.libxl_device_vsnd {
+		return C.libxl_device_vsnd_list(Ctx.ctx, C.uint32_t(domid), num)
+	}, freeDeviceVsndList)
+}
+
+// DeviceVsndGetInfo returns the state of the backend and frontend of a
+// virtual sound card of a domain, and of each of its PCMs and streams.
+func (Ctx *Context) DeviceVsndGetInfo(domid Domid, vsnd *DeviceVsnd) (Vsndinfo, error) {
+	var info Vsndinfo
+
+	var cvsnd C.libxl_device_vsnd
+	if err := vsnd.toC(&cvsnd); err != nil {
+		return info, err
+	}
+	defer C.libxl_device_vsnd_dispose(&cvsnd)
+
+	var cinfo C.libxl_vsndinfo
+	C.libxl_vsndinfo_init(&cinfo)
+	defer C.libxl_vsndinfo_dispose(&cinfo)
+
+	ret := C.libxl_device_vsnd_getinfo(Ctx.ctx, C.uint32_t(domid), &cvsnd, &cinfo)
+	if ret != 0 {
+		return info, Error(ret)
+	}
+
+	err := info.fromC(&cinfo)
+
+	return info, err
+}
+
+// DeviceP9Remove removes a 9pfs device from a domain.
+func (Ctx *Context) DeviceP9Remove(domid Domid, p9 *DeviceP9, op *AsyncOp) error {
+	return deviceOp(Ctx, p9, disposeDeviceP9, func(cp9 *C.libxl_device_p9, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_p9_remove(Ctx.ctx, C.uint32_t(domid), cp9, how)
+	}, op)
+}
+
+// DeviceP9Destroy forcibly removes a 9pfs device from a domain, without
+// waiting for the guest to release it.
+func (Ctx *Context) DeviceP9Destroy(domid Domid, p9 *DeviceP9, op *AsyncOp) error {
+	return deviceOp(Ctx, p9, disposeDeviceP9, func(cp9 *C.libxl_device_p9, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_p9_destroy(Ctx.ctx, C.uint32_t(domid), cp9, how)
+	}, op)
+}
+
+// DevicePvcallsifRemove removes a PV calls interface from a domain.
+func (Ctx *Context) DevicePvcallsifRemove(domid Domid, pvcallsif *DevicePvcallsif, op *AsyncOp) error {
+	return deviceOp(Ctx, pvcallsif, disposeDevicePvcallsif, func(cpvcallsif *C.libxl_device_pvcallsif, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pvcallsif_remove(Ctx.ctx, C.uint32_t(domid), cpvcallsif, how)
+	}, op)
+}
+
+// DevicePvcallsifDestroy forcibly removes a PV calls interface from a
+// domain, without waiting for the guest to release it.
+func (Ctx *Context) DevicePvcallsifDestroy(domid Domid, pvcallsif *DevicePvcallsif, op *AsyncOp) error {
+	return deviceOp(Ctx, pvcallsif, disposeDevicePvcallsif, func(cpvcallsif *C.libxl_device_pvcallsif, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pvcallsif_destroy(Ctx.ctx, C.uint32_t(domid), cpvcallsif, how)
+	}, op)
+}
+
+// DomainCreateNew creates a new domain.
+//
+// If op is not nil, the returned Domid is not valid; the ID of the new
+// domain is instead given by op.Domid once the operation has completed.
+func (Ctx *Context) DomainCreateNew(config *DomainConfig, op *AsyncOp) (Domid, error) {
+	cconfig := (*C.libxl_domain_config)(C.calloc(1, C.sizeof_libxl_domain_config))
+	err := config.toC(cconfig)
+	if err != nil {
+		C.free(unsafe.Pointer(cconfig))
+		return Domid(0), fmt.Errorf("converting domain config to C: %v", err)
+	}
+	cdomid := (*C.uint32_t)(C.calloc(1, C.sizeof_uint32_t))
+
+	wait := op == nil
+	if wait {
+		op = NewAsyncOp(context.Background())
+	}
+
+	err = Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_domain_create_new(Ctx.ctx, cconfig, cdomid, how, nil)
+	}, func(op *AsyncOp) {
+		op.domid = Domid(*cdomid)
+		C.libxl_domain_config_dispose(cconfig)
+		C.free(unsafe.Pointer(cconfig))
+		C.free(unsafe.Pointer(cdomid))
+	})
+	if err != nil || !wait {
+		return Domid(0), err
+	}
+
+	if err = op.Wait(); err != nil {
+		return Domid(0), err
+	}
+
+	return op.Domid(), nil
+}
+
+// SaveOptions controls how SaveDomain saves a domain.
+type SaveOptions struct {
+	// Live saves the domain while it keeps running, as is done
+	// for live migration (LIBXL_SUSPEND_LIVE).
+	Live bool
+
+	// Debug makes the save verify that the domain's memory is
+	// unchanged once it has been suspended (LIBXL_SUSPEND_DEBUG).
+	Debug bool
+
+	// Checkpoint leaves the domain running once it has been
+	// saved, rather than destroying it.
+	Checkpoint bool
+
+	// LeavePaused leaves the domain paused once it has been saved,
+	// rather than destroying it.
+	LeavePaused bool
+}
+
+// SaveDomain suspends a domain, and writes its state to w. If opts is
+// nil, the domain is saved with default options, and destroyed once it
+// has been saved.
+//
+// Only libxl's image of the domain is written; the domain configuration
+// to restore it with must be kept separately. If w is an *os.File, libxl
+// writes to it directly; otherwise the image is copied to w through a
+// pipe. If saving fails, the domain is resumed.
+func (Ctx *Context) SaveDomain(domid Domid, w io.Writer, opts *SaveOptions, op *AsyncOp) error {
+	if opts == nil {
+		opts = &SaveOptions{}
+	}
+
+	var flags C.int
+	if opts.Live {
+		flags |= C.LIBXL_SUSPEND_LIVE
+	}
+	if opts.Debug {
+		flags |= C.LIBXL_SUSPEND_DEBUG
+	}
+
+	return Ctx.suspendDomain(domid, w, flags, func(op *AsyncOp) {
+		switch {
+		case op.err != nil:
+			// As xl does, let the domain carry on.
+			Ctx.DomainResume(domid, true, nil)
+
+		case opts.Checkpoint, opts.LeavePaused:
+			if opts.LeavePaused {
+				if err := Ctx.DomainPause(domid, nil); err != nil {
+					op.err = err
+				}
+			}
+			if err := Ctx.DomainResume(domid, true, nil); err != nil {
+				op.err = err
+			}
+
+		default:
+			op.err = Ctx.DomainDestroy(domid, nil)
+		}
+	}, op)
+}
+
+// suspendDomain suspends a domain, and writes its state to w, leaving the
+// domain suspended. If the operation was started, after, if not nil, is
+// called once the state has been written, and may change the result of
+// the operation.
+func (Ctx *Context) suspendDomain(domid Domid, w io.Writer, flags C.int, after func(op *AsyncOp), op *AsyncOp) error {
+	fd, streamDone, err := streamTo(w)
+	if err != nil {
+		return err
+	}
+
+	started := false
+
+	return Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		started = true
+		return C.libxl_domain_suspend(Ctx.ctx, C.uint32_t(domid), fd, flags, how)
+	}, func(op *AsyncOp) {
+		if err := streamDone(); err != nil && op.err == nil {
+			op.err = fmt.Errorf("writing domain image: %v", err)
+		}
+		if started && after != nil {
+			after(op)
+		}
+	})
+}
+
+// RestoreDomain creates a new domain from config, restoring its state from
+// an image read from r, as written by SaveDomain. params may be nil.
+//
+// If r is an *os.File, libxl reads from it directly, and reads no more
+// than the image; otherwise the image is copied from r through a pipe.
+// Once libxl is done, a read from r still in progress is interrupted by
+// a read deadline, if r has a SetReadDeadline method. r is never closed:
+// a read from any other reader is left to complete, and keeps a goroutine
+// running until it does. Data or errors it returns are not part of the
+// image, and are ignored.
+//
+// If op is not nil, the returned Domid is not valid; the ID of the new
+// domain is instead given by op.Domid once the operation has completed.
+func (Ctx *Context) RestoreDomain(config *DomainConfig, r io.Reader, params *DomainRestoreParams, op *AsyncOp) (Domid, error) {
+	cconfig := (*C.libxl_domain_config)(C.calloc(1, C.sizeof_libxl_domain_config))
+	if err := config.toC(cconfig); err != nil {
+		C.free(unsafe.Pointer(cconfig))
+		return Domid(0), fmt.Errorf("converting domain config to C: %v", err)
+	}
+
+	s, err := newInStream(r)
+	if err != nil {
+		C.libxl_domain_config_dispose(cconfig)
+		C.free(unsafe.Pointer(cconfig))
+		return Domid(0), err
+	}
+
+	return Ctx.restoreDomain(cconfig, s, params, op)
+}
+
+// restoreDomain is RestoreDomain, for a config already converted to C,
+// which it takes ownership of.
+func (Ctx *Context) restoreDomain(cconfig *C.libxl_domain_config, s *inStream, params *DomainRestoreParams, op *AsyncOp) (Domid, error) {
+	if params == nil {
+		params = &DomainRestoreParams{}
+	}
+
+	cparams := (*C.libxl_domain_restore_params)(C.calloc(1, C.sizeof_libxl_domain_restore_params))
+	cdomid := (*C.uint32_t)(C.calloc(1, C.sizeof_uint32_t))
+
+	free := func() {
+		C.libxl_domain_restore_params_dispose(cparams)
+		C.free(unsafe.Pointer(cparams))
+		C.libxl_domain_config_dispose(cconfig)
+		C.free(unsafe.Pointer(cconfig))
+		C.free(unsafe.Pointer(cdomid))
+	}
+
+	if err := params.toC(cparams); err != nil {
+		s.close()
+		free()
+		return Domid(0), fmt.Errorf("converting restore params to C: %v", err)
+	}
+
+	wait := op == nil
+	if wait {
+		op = NewAsyncOp(context.Background())
+	}
+
+	err := Ctx.doAsync(op, func(how *C.libxl_asyncop_how) C.int {
+		return C.libxl_domain_create_restore(Ctx.ctx, cconfig, cdomid, s.fd, -1, cparams, how, nil)
+	}, func(op *AsyncOp) {
+		if err := s.close(); err != nil && op.err != nil {
+			// Most likely why restoring failed.
+			op.err = fmt.Errorf("reading domain image: %v", err)
+		}
+		op.domid = Domid(*cdomid)
+		free()
+	})
+	if err != nil || !wait {
+		return Domid(0), err
+	}
+
+	if err = op.Wait(); err != nil {
+		return Domid(0), err
+	}
+
+	return op.Domid(), nil
+}
+
+// streamTo returns an fd for libxl to write a stream to, which ends up in
+// w; and a function to call once libxl is done with the fd, which returns
+// any error writing to w.
+func streamTo(w io.Writer) (C.int, func() error, error) {
+	if f, ok := w.(*os.File); ok {
+		return C.int(f.Fd()), func() error {
+			runtime.KeepAlive(f)
+			return nil
+		}, nil
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return -1, nil, err
+	}
+	r := os.NewFile(uintptr(p[0]), "libxl stream")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, r)
+		// If writing failed, this makes libxl fail too.
+		r.Close()
+		done <- err
+	}()
+
+	return C.int(p[1]), func() error {
+		syscall.Close(p[1])
+		return <-done
+	}, nil
+}
+
+// inStream is an fd for libxl to read a stream from, which comes from an
+// io.Reader.
+type inStream struct {
+	fd C.int
+	r  io.Reader
+
+	// Unless libxl reads from r directly, a goroutine copies r to
+	// fd through a pipe, until stop is closed.
+	file *os.File
+	stop chan struct{}
+	done chan struct{}
+
+	// mu guards err, which is only set before stop is closed.
+	mu  sync.Mutex
+	err error
+
+	// Valid once done is closed.
+	rest []byte
+}
+
+func newInStream(r io.Reader) (*inStream, error) {
+	s := &inStream{
+		r: r,
+	}
+
+	if f, ok := r.(*os.File); ok {
+		s.fd = C.int(f.Fd())
+		return s, nil
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+	s.fd = C.int(p[0])
+	s.file = os.NewFile(uintptr(p[1]), "libxl stream")
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go s.copy()
+
+	return s, nil
+}
+
+func (s *inStream) copy() {
+	defer close(s.done)
+	defer s.file.Close()
+
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := s.r.Read(buf)
+		if n > 0 {
+			select {
+			case <-s.stop:
+				// This follows the stream.
+				s.rest = buf[:n]
+				return
+			default:
+			}
+
+			w, werr := s.file.Write(buf[:n])
+			if werr != nil {
+				s.rest = buf[w:n]
+				s.setErr(werr)
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			s.setErr(err)
+			return
+		}
+	}
+}
+
+// setErr records err, unless close has already been called, in which
+// case it is the result of close interrupting the copy, or comes after
+// the end of the image.
+func (s *inStream) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.stop:
+	default:
+		s.err = err
+	}
+}
+
+// readDeadliner is implemented by readers whose reads can be interrupted
+// by a deadline, such as net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// close is called once libxl is done with the fd, and returns any error
+// reading from r that has occurred by then.
+func (s *inStream) close() error {
+	if s.file == nil {
+		runtime.KeepAlive(s.r)
+		return nil
+	}
+
+	s.mu.Lock()
+	close(s.stop)
+	err := s.err
+	s.mu.Unlock()
+
+	// A write to the pipe in progress fails once its read end is
+	// closed. A read from r in progress is interrupted if r supports
+	// it; otherwise the copy stops once the read completes.
+	syscall.Close(int(s.fd))
+
+	if r, ok := s.r.(readDeadliner); ok {
+		r.SetReadDeadline(time.Unix(1, 0))
+		<-s.done
+		r.SetReadDeadline(time.Time{})
+	}
+
+	return err
+}
+
+// remainder returns a reader for whatever follows the stream in r. It
+// must only be called once close has been, and blocks until the copy has
+// stopped, which for a reader that cannot be interrupted is once its read
+// in progress completes.
+func (s *inStream) remainder() io.Reader {
+	if s.file == nil {
+		return s.r
+	}
+
+	<-s.done
+
+	return io.MultiReader(bytes.NewReader(s.rest), s.r)
 }
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2016 George W. Dunlap, Citrix Systems UK Ltd
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xenlight
+
+import "testing"
+
+func TestDomainSchedParamsToSetWeightOnly(t *testing.T) {
+	unchanged := domainSchedParamsToSet(&DomainSchedParams{}, 0)
+
+	params := DomainSchedParams{Sched: SchedulerCredit, Weight: 512}
+	p := domainSchedParamsToSet(&params, SchedParamWeight)
+
+	if p.Weight != 512 {
+		t.Errorf("Weight = %v, want 512", p.Weight)
+	}
+	if p.Cap != unchanged.Cap || p.Cap == 0 {
+		t.Errorf("Cap = %v, want %v, leaving the cap unchanged", p.Cap, unchanged.Cap)
+	}
+	if p.Extratime != unchanged.Extratime {
+		t.Errorf("Extratime = %v, want %v", p.Extratime, unchanged.Extratime)
+	}
+}
+
+func TestDomainSchedParamsToSetCapZero(t *testing.T) {
+	params := DomainSchedParams{Sched: SchedulerCredit, Weight: 512}
+	p := domainSchedParamsToSet(&params, SchedParamCap)
+
+	if p.Cap != 0 {
+		t.Errorf("Cap = %v, want 0", p.Cap)
+	}
+	if unchanged := domainSchedParamsToSet(&params, 0); p.Weight != unchanged.Weight {
+		t.Errorf("Weight = %v, want %v", p.Weight, unchanged.Weight)
+	}
+}
+
+func TestMergeSchedParamsRtdsExtratime(t *testing.T) {
+	cur := SchedParams{Vcpuid: 1, Period: 10000, Budget: 4000, Extratime: 1}
+
+	tests := []struct {
+		name   string
+		params SchedParams
+		set    SchedParam
+		want   SchedParams
+	}{
+		{
+			name:   "budget only keeps extratime",
+			params: SchedParams{Budget: 5000},
+			set:    SchedParamBudget,
+			want:   SchedParams{Vcpuid: 1, Period: 10000, Budget: 5000, Extratime: 1},
+		},
+		{
+			name:   "extratime off",
+			params: SchedParams{Period: 20000, Extratime: 0},
+			set:    SchedParamExtratime,
+			want:   SchedParams{Vcpuid: 1, Period: 10000, Budget: 4000, Extratime: 0},
+		},
+		{
+			name:   "all",
+			params: SchedParams{Vcpuid: 3, Period: 20000, Budget: 8000, Extratime: 0},
+			set:    SchedParamPeriod | SchedParamBudget | SchedParamExtratime,
+			want:   SchedParams{Vcpuid: 1, Period: 20000, Budget: 8000, Extratime: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		got := cur
+		mergeSchedParams(got.fields(), tt.params.fields(), tt.set)
+		if got != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeSchedParamsDomainToVcpu(t *testing.T) {
+	cur := SchedParams{Vcpuid: 2, Period: 10000, Budget: 4000, Extratime: 1}
+	params := DomainSchedParams{Sched: SchedulerRtds, Period: 30000, Extratime: 0}
+
+	got := cur
+	mergeSchedParams(got.fields(), params.fields(), SchedParamPeriod)
+
+	want := SchedParams{Vcpuid: 2, Period: 30000, Budget: 4000, Extratime: 1}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUnusedSchedParams(t *testing.T) {
+	tests := []struct {
+		sched Scheduler
+		set   SchedParam
+		want  SchedParam
+	}{
+		{SchedulerCredit, SchedParamWeight | SchedParamCap, 0},
+		{SchedulerCredit2, SchedParamCap, 0},
+		{SchedulerCredit, SchedParamWeight | SchedParamExtratime, SchedParamExtratime},
+		{SchedulerRtds, SchedParamPeriod | SchedParamBudget | SchedParamExtratime, 0},
+		{SchedulerRtds, SchedParamWeight, SchedParamWeight},
+		{SchedulerNull, 0, 0},
+		{SchedulerNull, SchedParamWeight, SchedParamWeight},
+		{SchedulerUnknown, SchedParamWeight | SchedParamPeriod, 0},
+		{SchedulerUnknown, 1 << 8, 1 << 8},
+	}
+
+	for _, tt := range tests {
+		if got := unusedSchedParams(tt.sched, tt.set); got != tt.want {
+			t.Errorf("unusedSchedParams(%d, %v) = %v, want %v", tt.sched, tt.set, got, tt.want)
+		}
+	}
+}
+
+func TestSchedParamString(t *testing.T) {
+	tests := []struct {
+		p    SchedParam
+		want string
+	}{
+		{0, ""},
+		{SchedParamWeight, "Weight"},
+		{SchedParamCap | SchedParamExtratime, "Cap|Extratime"},
+		{SchedParamBudget | 1<<8, "Budget|SchedParam(0x100)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.p.String(); got != tt.want {
+			t.Errorf("SchedParam(%#x).String() = %q, want %q", uint(tt.p), got, tt.want)
+		}
+	}
+}